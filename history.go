@@ -0,0 +1,129 @@
+package main
+
+import (
+	"./plugin/database"
+	"./plugin/urls"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Subcommands for archiving the URL history, e.g.
+// voidbot export-urls -channel '#foo' foo.csv
+
+func exportURLs(args []string, running bool) error {
+	flags := flag.NewFlagSet("export-urls", flag.ContinueOnError)
+	format := flags.String("format", "", "jsonl or csv (default: from the file extension, or jsonl)")
+	channel := flags.String("channel", "", "only export URLs posted to this channel")
+	since := flags.String("since", "", "only export URLs posted on or after this date (YYYY-MM-DD)")
+	until := flags.String("until", "", "only export URLs posted on or before this date (YYYY-MM-DD)")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: export-urls [options] [file]")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return err
+	} else if flags.NArg() > 1 {
+		flags.Usage()
+		return flag.ErrHelp
+	}
+
+	filter := urls.Filter{Channel: *channel}
+	var err error
+	if filter.Since, err = parseDate(*since); err != nil {
+		return err
+	}
+	if filter.Until, err = parseDate(*until); err != nil {
+		return err
+	} else if !filter.Until.IsZero() {
+		filter.Until = filter.Until.AddDate(0, 0, 1)
+	}
+
+	path := flags.Arg(0)
+	var w io.Writer = os.Stdout
+	if path != "" && path != "-" {
+		f, err := os.Create(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+
+	db, err := urls.OpenHistory()
+	if err != nil {
+		return err
+	}
+	defer database.Close(db)
+	count, err := urls.Export(db, w, archiveFormat(*format, path), filter)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "exported %d URLs\n", count)
+	return nil
+}
+
+func importURLs(args []string, running bool) error {
+	flags := flag.NewFlagSet("import-urls", flag.ContinueOnError)
+	format := flags.String("format", "", "jsonl or csv (default: from the file extension, or jsonl)")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: import-urls [options] [file]")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return err
+	} else if flags.NArg() > 1 {
+		flags.Usage()
+		return flag.ErrHelp
+	}
+
+	path := flags.Arg(0)
+	var r io.Reader = os.Stdin
+	if path != "" && path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	} else if running {
+		return errors.New("a file must be given")
+	}
+
+	db, err := urls.OpenHistory()
+	if err != nil {
+		return err
+	}
+	defer database.Close(db)
+	imported, duplicates, excluded, err := urls.Import(db, r, archiveFormat(*format, path))
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "imported %d URLs, skipped %d duplicates and %d from excluded channels\n", imported, duplicates, excluded)
+	return nil
+}
+
+func archiveFormat(format, path string) string {
+	if format != "" {
+		return format
+	} else if strings.ToLower(filepath.Ext(path)) == ".csv" {
+		return urls.FormatCSV
+	}
+	return urls.FormatJSON
+}
+
+func parseDate(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	t, err := time.ParseInLocation("2006-01-02", s, time.Local)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid date %q, expected YYYY-MM-DD", s)
+	}
+	return t, nil
+}
@@ -2,9 +2,13 @@ package main
 
 import (
 	"./plugin"
+	"./plugin/cache"
+	"./plugin/database"
+	"./plugin/store"
+	"errors"
+	"flag"
 	"fmt"
 	"github.com/kballard/goirc/irc"
-	"io"
 	"io/ioutil"
 	"launchpad.net/goyaml"
 	"os"
@@ -12,6 +16,16 @@ import (
 	"syscall"
 )
 
+const Version = "0.1"
+
+var (
+	configPath  = flag.String("config", "config.yaml", "path to the config file")
+	dataDir     = flag.String("datadir", ".", "directory to store databases in")
+	checkOnly   = flag.Bool("check-config", false, "validate the config file and exit")
+	listPlugins = flag.Bool("list-plugins", false, "list the available plugins and exit")
+	showVersion = flag.Bool("version", false, "print the version and exit")
+)
+
 type Config struct {
 	Server     string `yaml:"server"`
 	Port       uint   `yaml:"port"`
@@ -26,22 +40,77 @@ type Config struct {
 
 	Plugins []string `yaml:"plugins"`
 
+	HTTP     map[string]interface{} `yaml:"http"`
+	Cache    map[string]interface{} `yaml:"cache"`
+	Database map[string]interface{} `yaml:"database"`
+
 	PluginConfig map[string]map[string]interface{} `yaml:"config"`
 }
 
 func main() {
-	config := checkConfig()
+	flag.Parse()
 
-	if config.Server == "" {
-		fmt.Fprintln(os.Stderr, "error: No valid server found in config.yaml")
+	if *showVersion {
+		fmt.Println("voidbot", Version)
+		return
+	}
+	if *listPlugins {
+		for _, name := range plugin.PluginNames() {
+			if name != "" {
+				fmt.Println(name)
+			}
+		}
+		return
+	}
+
+	config := checkConfig(*configPath)
+
+	if err := validateConfig(config); err != nil {
+		fmt.Fprintf(os.Stderr, "error: %s in %s\n", err, *configPath)
 		os.Exit(1)
-	} else if config.Nick == "" || config.User == "" || config.RealName == "" {
-		fmt.Fprintln(os.Stderr, "error: No valid user data found in config.yaml")
+	} else if err := plugin.ValidateConfig(config.Plugins, config.PluginConfig); err != nil {
+		fmt.Fprintf(os.Stderr, "error: %s\n", err)
+		os.Exit(1)
+	} else if err := plugin.ConfigureHTTP(config.HTTP); err != nil {
+		fmt.Fprintf(os.Stderr, "error: %s\n", err)
+		os.Exit(1)
+	} else if err := cache.Configure(config.Cache); err != nil {
+		fmt.Fprintf(os.Stderr, "error: %s\n", err)
+		os.Exit(1)
+	} else if err := database.Configure(config.Database); err != nil {
+		fmt.Fprintf(os.Stderr, "error: %s\n", err)
 		os.Exit(1)
 	} else if config.Plugins != nil && len(config.Plugins) == 0 {
 		fmt.Fprintln(os.Stderr, "warning: You have no plugins enabled. This bot will do nothing.")
 	}
 
+	// subcommands use the database backend from the config file
+	if flag.NArg() > 0 {
+		runSubcommand(flag.Args())
+		return
+	}
+
+	if *checkOnly {
+		fmt.Printf("%s: OK\n", *configPath)
+		return
+	}
+
+	if err := os.MkdirAll(*dataDir, 0755); err != nil {
+		fmt.Fprintln(os.Stderr, "error: could not create data directory:", err)
+		os.Exit(1)
+	}
+	database.SetDataDir(*dataDir)
+
+	if err := cache.Start(); err != nil {
+		fmt.Fprintln(os.Stderr, "error: could not open the cache:", err)
+		os.Exit(1)
+	}
+	defer cache.Stop()
+	database.StartBackups()
+	defer database.StopBackups()
+	store.SetNetwork(config.Server)
+	defer store.Close()
+
 	signals := make(chan os.Signal, 1)
 	signal.Notify(signals, os.Interrupt)
 	interrupt := make(chan struct{}, 1)
@@ -121,7 +190,7 @@ func main() {
 				reg.AddHandler(irc.CTCP, func(conn *irc.Conn, line irc.Line) {
 					fmt.Printf("Received CTCP[%s] from %s [%s]: %s\n", line.Args[0], line.Src.Nick, line.Src.Ident(), append(line.Args[1:len(line.Args)], "")[0])
 					if line.Args[0] == "VERSION" {
-						plugin.Conn(conn).CTCPReply(line.Src.Nick, "VERSION", "voidbot powered by github.com/kballard/goirc")
+						plugin.Conn(conn).CTCPReply(line.Src.Nick, "VERSION", "voidbot "+Version+" powered by github.com/kballard/goirc")
 					} else {
 						conn.DefaultCTCPHandler(line)
 					}
@@ -176,15 +245,15 @@ func main() {
 	fmt.Println("Goodbye")
 }
 
-func checkConfig() Config {
-	bytes, err := ioutil.ReadFile("config.yaml")
+func checkConfig(path string) Config {
+	bytes, err := ioutil.ReadFile(path)
 	if err != nil {
-		if perr, ok := err.(*os.PathError); ok && (perr.Err == os.ErrNotExist || perr.Err == syscall.ENOENT) {
-			if err := writeSampleConfig(); err != nil {
+		if perr, ok := err.(*os.PathError); ok && !*checkOnly && (perr.Err == os.ErrNotExist || perr.Err == syscall.ENOENT) {
+			if err := writeSampleConfig(path); err != nil {
 				fmt.Fprintf(os.Stderr, "Config file not found. An error occurred while trying to write the sample config: %s\n", err)
 				os.Exit(1)
 			} else {
-				fmt.Fprintln(os.Stderr, "Config file not found. A sample config has been written out as config.yaml")
+				fmt.Fprintf(os.Stderr, "Config file not found. A sample config has been written out as %s\n", path)
 				os.Exit(2)
 			}
 		} else {
@@ -194,22 +263,21 @@ func checkConfig() Config {
 	}
 	var config Config
 	if err := goyaml.Unmarshal(bytes, &config); err != nil {
-		fmt.Fprintf(os.Stderr, "An error occurred while reading config.yaml: %s", err)
+		fmt.Fprintf(os.Stderr, "An error occurred while reading %s: %s\n", path, err)
 		os.Exit(1)
 	}
 	return config
 }
 
-func writeSampleConfig() error {
-	in, err := os.Open("config.yaml.tmpl")
-	if err != nil {
-		return err
-	}
-	defer in.Close()
-	out, err := os.Create("config.yaml")
-	if err != nil {
-		return err
+func validateConfig(config Config) error {
+	if config.Server == "" {
+		return errors.New("No valid server found")
+	} else if config.Nick == "" || config.User == "" || config.RealName == "" {
+		return errors.New("No valid user data found")
 	}
-	_, err = io.Copy(out, in)
-	return err
+	return nil
+}
+
+func writeSampleConfig(path string) error {
+	return ioutil.WriteFile(path, []byte(sampleConfig), 0644)
 }
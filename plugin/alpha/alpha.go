@@ -2,20 +2,29 @@ package alpha
 
 import (
 	"../"
+	"../cache"
 	"encoding/xml"
 	"fmt"
 	"github.com/kballard/gocallback/callback"
 	"github.com/kballard/goirc/irc"
-	"net/http"
 	"net/url"
 	"strings"
+	"time"
 )
 
+var config = struct {
+	AppID    string `yaml:"app_id"`
+	Location string `yaml:"location"`
+}{
+	AppID:    "P9KHX4-E8QPJ45UTA",
+	Location: "San Francisco, CA",
+}
+
 func init() {
-	plugin.RegisterPlugin("alpha", plugin.Callbacks{Init: setup})
+	plugin.RegisterPlugin("alpha", plugin.Callbacks{Init: setup, Config: &config, Requires: []string{"COMMAND"}})
 }
 
-func setup(reg *callback.Registry, config map[string]interface{}) error {
+func setup(reg *callback.Registry, _ map[string]interface{}) error {
 	reg.AddCallback("COMMAND", func(conn *irc.Conn, line irc.Line, cmd, arg, reply string, isPrivate bool) {
 		if cmd == "alpha" {
 			arg = strings.TrimSpace(arg)
@@ -84,20 +93,14 @@ func runQuery(conn plugin.IrcConn, arg, reply string) {
 	runAPICall(conn, reply, arg, constructURL(arg), true, true)
 }
 
-func runAPICall(conn plugin.IrcConn, reply, query, url string, reinterpret, recalculate bool) {
-	resp, err := http.Get(url)
-	if err != nil {
-		fmt.Println("alpha:", err)
-		return
-	}
-	defer resp.Body.Close()
-	if resp.StatusCode != 200 {
-		fmt.Println("alpha: unexpected status code:", resp.StatusCode)
-		return
-	}
+var queryCache = cache.New("alpha", time.Hour)
 
+func runAPICall(conn plugin.IrcConn, reply, query, url string, reinterpret, recalculate bool) {
 	var result QueryResult
-	if err := xml.NewDecoder(resp.Body).Decode(&result); err != nil {
+	err := queryCache.Get(url, &result, func() (interface{}, error) {
+		return fetchQuery(url)
+	})
+	if err != nil {
 		fmt.Println("alpha:", err)
 		return
 	}
@@ -172,9 +175,26 @@ func runAPICall(conn plugin.IrcConn, reply, query, url string, reinterpret, reca
 	}
 }
 
+func fetchQuery(url string) (QueryResult, error) {
+	resp, err := plugin.HTTPGet(url)
+	if err != nil {
+		return QueryResult{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return QueryResult{}, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+
+	var result QueryResult
+	if err := xml.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return QueryResult{}, err
+	}
+	return result, nil
+}
+
 func constructURL(query string) string {
 	query = url.QueryEscape(query)
-	location := url.QueryEscape("San Francisco, CA")
-	appid := url.QueryEscape("P9KHX4-E8QPJ45UTA")
+	location := url.QueryEscape(config.Location)
+	appid := url.QueryEscape(config.AppID)
 	return fmt.Sprintf("http://api.wolframalpha.com/v2/query?input=%s&appid=%s&format=plaintext&location=%s&podindex=1,2", query, appid, location)
 }
@@ -2,12 +2,13 @@ package appdotnet
 
 import (
 	"../"
+	"../cache"
+	"../urlevent"
 	"encoding/json"
 	"fmt"
 	"github.com/kballard/gocallback/callback"
 	"github.com/kballard/goirc/irc"
 	"io/ioutil"
-	"net/http"
 	"net/url"
 	"strings"
 	"time"
@@ -26,15 +27,15 @@ func (p Post) String() string {
 }
 
 func init() {
-	plugin.RegisterPlugin("appdotnet", plugin.Callbacks{Init: setup})
+	plugin.RegisterPlugin("appdotnet", plugin.Callbacks{Init: setup, Requires: []string{"URL"}})
 }
 
 func setup(reg *callback.Registry, config map[string]interface{}) error {
-	reg.AddCallback("URL", func(conn *irc.Conn, line irc.Line, dst string, url *url.URL) {
+	urlevent.AddClaimer(func(conn *irc.Conn, line irc.Line, dst string, url *url.URL, claim *urlevent.Claim) {
 		if url.Scheme == "http" || url.Scheme == "https" {
 			if url.Host == "alpha.app.net" {
 				comps := strings.Split(strings.TrimLeft(url.Path, "/"), "/")
-				if len(comps) > 2 && comps[1] == "post" {
+				if len(comps) > 2 && comps[1] == "post" && claim.Take("appdotnet") {
 					id := comps[2]
 					go fetchADNPost(plugin.Conn(conn), line, dst, id)
 				}
@@ -55,38 +56,47 @@ type Payload struct {
 	} `json:"data"`
 }
 
+var postCache = cache.New("appdotnet", time.Hour)
+
 func fetchADNPost(conn plugin.IrcConn, line irc.Line, dst, id string) {
-	url := fmt.Sprintf("https://alpha-api.app.net/stream/0/posts/%s", id)
-	resp, err := http.Get(url)
+	var post Post
+	err := postCache.Get(id, &post, func() (interface{}, error) {
+		return fetchPost(id)
+	})
 	if err != nil {
 		fmt.Println("appdotnet:", err)
 		return
 	}
+
+	conn.NoticeN(dst, post.String(), 4)
+}
+
+func fetchPost(id string) (Post, error) {
+	url := fmt.Sprintf("https://alpha-api.app.net/stream/0/posts/%s", id)
+	resp, err := plugin.HTTPGet(url)
+	if err != nil {
+		return Post{}, err
+	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != 200 {
-		fmt.Println("appdotnet: unexpected response:", resp)
-		return
+		return Post{}, fmt.Errorf("unexpected response: %s", resp.Status)
 	}
 
 	respData, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		fmt.Println("appdotnet:", err)
-		return
+		return Post{}, err
 	}
 
 	var payload Payload
 	if err = json.Unmarshal(respData, &payload); err != nil {
-		fmt.Println("appdotnet:", err)
-		return
+		return Post{}, err
 	}
 
-	var post = Post{
+	return Post{
 		Username:  payload.Data.User.Username,
 		Fullname:  payload.Data.User.Name,
 		Text:      payload.Data.Text,
 		Timestamp: payload.Data.Timestamp,
-	}
-
-	conn.NoticeN(dst, post.String(), 4)
+	}, nil
 }
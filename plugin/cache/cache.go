@@ -0,0 +1,325 @@
+package cache
+
+import (
+	"../"
+	"../database"
+	"container/list"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// Cache is a namespace within the shared response cache, used by plugins to
+// avoid repeating identical web requests. Values are stored as JSON, so they
+// must survive a round trip through encoding/json. Failures are cached too,
+// for the (shorter) negative TTL.
+//
+// The cache is bounded to a maximum number of entries across all namespaces,
+// evicting the least recently used. If persistence is enabled, entries are
+// also written to cache.db so they survive restarts.
+type Cache struct {
+	namespace string
+	ttl       time.Duration
+}
+
+// Config is read from the cache section of the config file.
+type Config struct {
+	MaxEntries  int           `yaml:"max_entries"`
+	NegativeTTL time.Duration `yaml:"negative_ttl"`
+	Persist     bool          `yaml:"persist"`
+}
+
+func (c *Config) Validate() error {
+	if c.MaxEntries <= 0 {
+		return errors.New("max_entries must be positive")
+	} else if c.NegativeTTL < 0 {
+		return errors.New("negative_ttl must not be negative")
+	}
+	return nil
+}
+
+type entry struct {
+	namespace string
+	name      string // the key within the namespace
+	key       string
+	value     []byte
+	err       string
+	expires   time.Time
+}
+
+type call struct {
+	wg    sync.WaitGroup
+	value []byte
+	err   error
+}
+
+var state struct {
+	sync.Mutex
+	config   Config
+	entries  map[string]*list.Element
+	lru      *list.List
+	inflight map[string]*call
+	db       *sql.DB
+	writer   *database.Writer
+}
+
+func init() {
+	state.config = Config{MaxEntries: 1000, NegativeTTL: 5 * time.Minute}
+	state.entries = make(map[string]*list.Element)
+	state.lru = list.New()
+	state.inflight = make(map[string]*call)
+	database.RegisterMigrations("cache.db", "cache",
+		database.Migration{Version: 1, Description: "create cache table", SQL: []string{
+			"CREATE TABLE IF NOT EXISTS cache (namespace text not null, key text not null, value blob, err text not null, expires datetime not null, primary key (namespace, key))",
+			"CREATE INDEX IF NOT EXISTS expires_idx ON cache (expires)",
+		}, DriverSQL: map[string][]string{"postgres": {
+			"CREATE TABLE IF NOT EXISTS cache (namespace text not null, key text not null, value bytea, err text not null, expires timestamptz not null, primary key (namespace, key))",
+			"CREATE INDEX IF NOT EXISTS expires_idx ON cache (expires)",
+		}}},
+	)
+}
+
+// Configure reads the cache section of the config file.
+func Configure(raw map[string]interface{}) error {
+	state.Lock()
+	defer state.Unlock()
+	config := state.config
+	if err := plugin.DecodeConfig("cache", raw, &config); err != nil {
+		return err
+	}
+	state.config = config
+	return nil
+}
+
+// Start opens the persistent cache, if enabled, and discards expired entries
+// and any beyond the size limit.
+func Start() error {
+	state.Lock()
+	defer state.Unlock()
+	if !state.config.Persist {
+		return nil
+	}
+	db, err := database.OpenNamed("cache.db")
+	if err != nil {
+		return err
+	}
+	sqls := []string{
+		"DELETE FROM cache WHERE expires < ?",
+		"DELETE FROM cache WHERE (namespace, key) NOT IN (SELECT namespace, key FROM cache ORDER BY expires DESC LIMIT ?)",
+	}
+	args := []interface{}{time.Now(), state.config.MaxEntries}
+	for i, sqlstr := range sqls {
+		if _, err := db.Exec(sqlstr, args[i]); err != nil {
+			database.Close(db)
+			return err
+		}
+	}
+	state.db = db
+	state.writer = database.NewWriter("cache", db, writeBatchSize, writeInterval)
+	return nil
+}
+
+// Stop writes any pending changes and closes the persistent cache.
+func Stop() error {
+	state.Lock()
+	db, writer := state.db, state.writer
+	state.db, state.writer = nil, nil
+	state.Unlock()
+	if db == nil {
+		return nil
+	}
+	writer.Close()
+	return database.Close(db)
+}
+
+// New returns the cache namespace for the given name (typically the plugin
+// name). Values stored in it expire after ttl.
+func New(namespace string, ttl time.Duration) *Cache {
+	return &Cache{namespace: namespace, ttl: ttl}
+}
+
+// Get looks up key and decodes the cached value into result. On a miss, fetch
+// is called to produce the value, which is cached and then decoded into
+// result. If fetch fails, the error is cached and returned. Concurrent
+// lookups of the same key share a single fetch.
+func (c *Cache) Get(key string, result interface{}, fetch func() (interface{}, error)) error {
+	fullKey := c.namespace + "\x00" + key
+
+	state.Lock()
+	ent, expired, ok := lookup(fullKey)
+	if ok {
+		state.Unlock()
+		if ent.err != "" {
+			return errors.New(ent.err)
+		}
+		return json.Unmarshal(ent.value, result)
+	}
+	// whoever refreshes an expired entry overwrites its row in the database
+	if cl, ok := state.inflight[fullKey]; ok {
+		state.Unlock()
+		cl.wg.Wait()
+		if cl.err != nil {
+			return cl.err
+		}
+		return json.Unmarshal(cl.value, result)
+	}
+	cl := &call{}
+	cl.wg.Add(1)
+	state.inflight[fullKey] = cl
+	db := state.db
+	state.Unlock()
+
+	if ent, ok := load(db, c.namespace, key, fullKey); ok {
+		state.Lock()
+		delete(state.inflight, fullKey)
+		evicted := insert(ent)
+		state.Unlock()
+		remove(evicted)
+		if ent.err != "" {
+			cl.err = errors.New(ent.err)
+		}
+		cl.value = ent.value
+		cl.wg.Done()
+		if cl.err != nil {
+			return cl.err
+		}
+		return json.Unmarshal(cl.value, result)
+	}
+
+	value, err := fetch()
+	if err == nil {
+		cl.value, err = json.Marshal(value)
+	}
+	cl.err = err
+
+	state.Lock()
+	ent = &entry{namespace: c.namespace, name: key, key: fullKey, value: cl.value, expires: time.Now().Add(c.ttl)}
+	if err != nil {
+		ent.err = err.Error()
+		negTTL := state.config.NegativeTTL
+		if negTTL > c.ttl {
+			negTTL = c.ttl
+		}
+		ent.expires = time.Now().Add(negTTL)
+	}
+	delete(state.inflight, fullKey)
+	var evicted []*entry
+	live := ent.expires.After(time.Now())
+	if live {
+		evicted = insert(ent)
+	}
+	state.Unlock()
+	if live {
+		save(ent)
+	} else if expired != nil {
+		evicted = append(evicted, expired)
+	}
+	remove(evicted)
+	cl.wg.Done()
+
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(cl.value, result)
+}
+
+// lookup finds a live entry in memory. An expired entry is dropped and
+// returned, so that its row can be removed from the database if it isn't
+// replaced. It must be called with state locked.
+func lookup(fullKey string) (ent, expired *entry, ok bool) {
+	if elt, ok := state.entries[fullKey]; ok {
+		ent := elt.Value.(*entry)
+		if time.Now().Before(ent.expires) {
+			state.lru.MoveToFront(elt)
+			return ent, nil, true
+		}
+		state.lru.Remove(elt)
+		delete(state.entries, fullKey)
+		return nil, ent, false
+	}
+	return nil, nil, false
+}
+
+// insert adds ent to the LRU list, returning the entries evicted to make
+// room. It must be called with state locked.
+func insert(ent *entry) []*entry {
+	if elt, ok := state.entries[ent.key]; ok {
+		state.lru.Remove(elt)
+	}
+	state.entries[ent.key] = state.lru.PushFront(ent)
+	var evicted []*entry
+	for state.lru.Len() > state.config.MaxEntries {
+		elt := state.lru.Back()
+		state.lru.Remove(elt)
+		delete(state.entries, elt.Value.(*entry).key)
+		evicted = append(evicted, elt.Value.(*entry))
+	}
+	return evicted
+}
+
+// The persistent cache is read on a miss in memory, without state locked,
+// and written in the background, so that disk I/O doesn't hold up other
+// lookups. Entries evicted from memory are deleted from it too, so it's
+// bounded by max_entries.
+const (
+	writeBatchSize = 50
+	writeInterval  = time.Second
+)
+
+// load reads an entry from the persistent cache, if it's enabled.
+func load(db *sql.DB, namespace, key, fullKey string) (*entry, bool) {
+	if db == nil {
+		return nil, false
+	}
+	ent := &entry{namespace: namespace, name: key, key: fullKey}
+	row := db.QueryRow("SELECT value, err, expires FROM cache WHERE namespace = ? AND key = ? AND expires > ?", namespace, key, time.Now())
+	if err := row.Scan(&ent.value, &ent.err, &ent.expires); err == nil {
+		return ent, true
+	} else if err != sql.ErrNoRows {
+		fmt.Fprintln(os.Stderr, "cache:", err)
+	}
+	return nil, false
+}
+
+// save queues ent to be written to the persistent cache, if it's enabled.
+func save(ent *entry) {
+	write(func(tx *sql.Tx) error {
+		sqlstr := "INSERT INTO cache (namespace, key, value, err, expires) VALUES (?, ?, ?, ?, ?) ON CONFLICT (namespace, key) DO UPDATE SET value = excluded.value, err = excluded.err, expires = excluded.expires"
+		if _, err := tx.Exec(sqlstr, ent.namespace, ent.name, ent.value, ent.err, ent.expires); err != nil {
+			return fmt.Errorf("%q: %s", err, sqlstr)
+		}
+		return nil
+	})
+}
+
+// remove queues entries to be deleted from the persistent cache, if it's
+// enabled.
+func remove(ents []*entry) {
+	if len(ents) == 0 {
+		return
+	}
+	write(func(tx *sql.Tx) error {
+		for _, ent := range ents {
+			if _, err := tx.Exec("DELETE FROM cache WHERE namespace = ? AND key = ?", ent.namespace, ent.name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func write(f func(tx *sql.Tx) error) {
+	state.Lock()
+	writer := state.writer
+	state.Unlock()
+	if writer == nil {
+		return
+	}
+	if err := writer.Write(f); err != nil && err != database.ErrWriterClosed {
+		fmt.Fprintln(os.Stderr, "cache:", err)
+	}
+}
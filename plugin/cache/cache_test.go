@@ -0,0 +1,152 @@
+package cache
+
+import (
+	"../database"
+	"container/list"
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+// reset empties the cache and applies config, opening a persistent cache in a
+// temporary directory if config.Persist is set.
+func reset(t *testing.T, config Config) func() {
+	state.Lock()
+	state.config = config
+	state.entries = make(map[string]*list.Element)
+	state.lru = list.New()
+	state.Unlock()
+	if !config.Persist {
+		return func() {}
+	}
+	dir, err := ioutil.TempDir("", "cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	database.SetDataDir(dir)
+	if err := Start(); err != nil {
+		t.Fatal(err)
+	}
+	return func() {
+		Stop()
+		os.RemoveAll(dir)
+	}
+}
+
+// persisted stops the cache, flushing its writes, and returns the values of
+// the rows in cache.db by key.
+func persisted(t *testing.T) map[string]string {
+	if err := Stop(); err != nil {
+		t.Fatal(err)
+	}
+	db, err := database.OpenNamed("cache.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer database.Close(db)
+	rows, err := db.Query("SELECT key, value FROM cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	values := make(map[string]string)
+	for rows.Next() {
+		var key string
+		var value []byte
+		if err := rows.Scan(&key, &value); err != nil {
+			t.Fatal(err)
+		}
+		values[key] = string(value)
+	}
+	return values
+}
+
+func get(t *testing.T, c *Cache, key, value string) string {
+	var result string
+	if err := c.Get(key, &result, func() (interface{}, error) { return value, nil }); err != nil {
+		t.Fatalf("Get(%q): %v", key, err)
+	}
+	return result
+}
+
+func TestGet(t *testing.T) {
+	defer reset(t, Config{MaxEntries: 2, NegativeTTL: time.Minute})()
+	c := New("test", time.Hour)
+
+	if got := get(t, c, "a", "1"); got != "1" {
+		t.Errorf("first Get = %q, want 1", got)
+	}
+	if got := get(t, c, "a", "2"); got != "1" {
+		t.Errorf("cached Get = %q, want 1", got)
+	}
+	get(t, c, "b", "1")
+	get(t, c, "c", "1")
+	if got := get(t, c, "a", "3"); got != "3" {
+		t.Errorf("Get after eviction = %q, want 3", got)
+	}
+
+	fail := errors.New("failed")
+	calls := 0
+	for i := 0; i < 2; i++ {
+		var result string
+		err := c.Get("d", &result, func() (interface{}, error) {
+			calls++
+			return nil, fail
+		})
+		if err == nil || err.Error() != fail.Error() {
+			t.Errorf("Get of a failed lookup = %v, want %v", err, fail)
+		}
+	}
+	if calls != 1 {
+		t.Errorf("failed lookup was fetched %d times, want 1", calls)
+	}
+}
+
+func TestRefreshKeepsPersistedRow(t *testing.T) {
+	defer reset(t, Config{MaxEntries: 10, NegativeTTL: time.Minute, Persist: true})()
+	c := New("test", 10*time.Millisecond)
+
+	get(t, c, "a", "1")
+	time.Sleep(20 * time.Millisecond)
+	if got := get(t, c, "a", "2"); got != "2" {
+		t.Fatalf("Get of an expired entry = %q, want 2", got)
+	}
+	if got := persisted(t)["a"]; got != `"2"` {
+		t.Errorf("persisted value = %q, want %q", got, `"2"`)
+	}
+}
+
+func TestEvictionRemovesRows(t *testing.T) {
+	defer reset(t, Config{MaxEntries: 2, NegativeTTL: time.Minute, Persist: true})()
+	c := New("test", time.Hour)
+
+	for _, key := range []string{"a", "b", "c", "d"} {
+		get(t, c, key, key)
+	}
+	values := persisted(t)
+	if len(values) != 2 || values["c"] == "" || values["d"] == "" {
+		t.Errorf("persisted %v, want c and d", values)
+	}
+}
+
+func TestLoadPersisted(t *testing.T) {
+	defer reset(t, Config{MaxEntries: 10, NegativeTTL: time.Minute, Persist: true})()
+	c := New("test", time.Hour)
+
+	get(t, c, "a", "1")
+	if err := Stop(); err != nil {
+		t.Fatal(err)
+	}
+	state.Lock()
+	state.entries = make(map[string]*list.Element)
+	state.lru = list.New()
+	state.Unlock()
+	if err := Start(); err != nil {
+		t.Fatal(err)
+	}
+	if got := get(t, c, "a", "2"); got != "1" {
+		t.Errorf("Get after restart = %q, want 1", got)
+	}
+}
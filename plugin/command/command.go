@@ -2,6 +2,7 @@ package command
 
 import (
 	"../"
+	"../../utils"
 	"fmt"
 	"github.com/kballard/gocallback/callback"
 	"github.com/kballard/goirc/irc"
@@ -11,7 +12,7 @@ import (
 )
 
 func init() {
-	plugin.RegisterPlugin("", plugin.Callbacks{Init: pluginInit, NewConnection: setup, Teardown: pluginTeardown})
+	plugin.RegisterPlugin("", plugin.Callbacks{Init: pluginInit, NewConnection: setup, Teardown: pluginTeardown, Provides: []string{"COMMAND", "PRIVMSG", "WHISPER", "ACTION"}})
 }
 
 const CommandPrefix = "!"
@@ -47,11 +48,11 @@ func setup(reg irc.HandlerRegistry) {
 				arg = words[1]
 			}
 			reply, isPrivate := dst, false
-			if !isChannelName(reply) {
+			if !utils.IsChannelName(reply) {
 				reply, isPrivate = line.Src.Nick, true
 			}
 			pluginReg.Dispatch("COMMAND", conn, line, cmd, arg, reply, isPrivate)
-		} else if isChannelName(dst) {
+		} else if utils.IsChannelName(dst) {
 			pluginReg.Dispatch("PRIVMSG", conn, line, dst, text)
 		} else if dst == conn.Me().Nick {
 			pluginReg.Dispatch("WHISPER", conn, line, text)
@@ -62,11 +63,7 @@ func setup(reg irc.HandlerRegistry) {
 	reg.AddHandler(irc.ACTION, func(conn *irc.Conn, line irc.Line) {
 		dst := line.Dst
 		text := line.Args[0]
-		isPrivate := !isChannelName(dst)
+		isPrivate := !utils.IsChannelName(dst)
 		pluginReg.Dispatch("ACTION", conn, line, dst, text, isPrivate)
 	})
 }
-
-func isChannelName(name string) bool {
-	return len(name) > 0 && (name[0] == '#' || name[0] == '&' || name[0] == '!' || name[0] == '+')
-}
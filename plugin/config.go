@@ -0,0 +1,348 @@
+package plugin
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Plugins may declare a typed config by setting Callbacks.Config to a pointer
+// to a struct. Before the plugin's Init is called, its section of the config
+// file is decoded into that struct. Keys are matched using the yaml struct tag
+// (or the lowercased field name), and fields tagged `config:"required"` must be
+// present. If the struct has a Validate() error method, it is called after
+// decoding. Any values initially set in the struct act as defaults.
+//
+// String values of the form ${NAME} are replaced with the value of the
+// environment variable NAME, which is useful for keeping secrets out of the
+// config file.
+
+type ConfigError struct {
+	Section string // e.g. `plugin "flickr"`
+	Key     string
+	Msg     string
+}
+
+func (e *ConfigError) Error() string {
+	if e.Key == "" {
+		return fmt.Sprintf("config for %s: %s", e.Section, e.Msg)
+	}
+	return fmt.Sprintf("config for %s: key %q: %s", e.Section, e.Key, e.Msg)
+}
+
+// ValidateConfig resolves the plugin list and decodes the config of every
+// plugin that would be loaded, without initializing anything. Plugins that
+// will be enabled to satisfy dependencies are reported on stderr.
+func ValidateConfig(plugins []string, config map[string]map[string]interface{}) error {
+	pluginState.Lock()
+	defer pluginState.Unlock()
+	known := make(map[string]bool, len(pluginState.Plugins))
+	for _, plugin := range pluginState.Plugins {
+		known[plugin.Name] = true
+	}
+	for name := range config {
+		if !known[name] {
+			fmt.Fprintf(os.Stderr, "warning: config found for unknown plugin %q\n", name)
+		}
+	}
+	order, notes, err := resolvePlugins(plugins)
+	if err != nil {
+		return err
+	}
+	for _, note := range notes {
+		fmt.Fprintln(os.Stderr, "note:", note)
+	}
+	for _, plugin := range order {
+		if _, err := pluginConfig(plugin, config[plugin.Name]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pluginConfig performs environment substitution on the raw config and
+// decodes it into the plugin's typed config, if it has one. This is only done
+// once, by ValidateConfig, and later calls return the same result, so that
+// warnings aren't repeated. pluginState must be locked by the caller.
+func pluginConfig(plugin *Plugin, raw map[string]interface{}) (map[string]interface{}, error) {
+	if plugin.decoded {
+		return plugin.config, nil
+	}
+	d := decoder{section: fmt.Sprintf("plugin %q", plugin.Name)}
+	expanded, err := d.expandEnv("", raw)
+	if err != nil {
+		return nil, err
+	}
+	raw, _ = expanded.(map[string]interface{})
+	if plugin.Callbacks.Config != nil {
+		if err := d.decodeInto(raw, plugin.Callbacks.Config); err != nil {
+			return nil, err
+		}
+	}
+	plugin.config, plugin.decoded = raw, true
+	return raw, nil
+}
+
+// DecodeConfig decodes a section of the config file into the struct pointed
+// to by out, in the same way as a plugin's typed config.
+func DecodeConfig(section string, raw map[string]interface{}, out interface{}) error {
+	d := decoder{section: section}
+	expanded, err := d.expandEnv("", raw)
+	if err != nil {
+		return err
+	}
+	return d.decodeInto(expanded, out)
+}
+
+var envRegex = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+type decoder struct {
+	section string
+}
+
+func (d decoder) errorf(key, format string, args ...interface{}) error {
+	return &ConfigError{Section: d.section, Key: key, Msg: fmt.Sprintf(format, args...)}
+}
+
+func (d decoder) decodeInto(in interface{}, out interface{}) error {
+	v := reflect.ValueOf(out)
+	if v.Kind() != reflect.Ptr || v.Elem().Kind() != reflect.Struct {
+		panic(fmt.Sprintf("config for %s must be decoded into a pointer to a struct", d.section))
+	}
+	if err := d.decode("", in, v.Elem()); err != nil {
+		return err
+	}
+	if validator, ok := out.(interface {
+		Validate() error
+	}); ok {
+		if err := validator.Validate(); err != nil {
+			return &ConfigError{Section: d.section, Msg: err.Error()}
+		}
+	}
+	return nil
+}
+
+func joinKey(prefix, key string) string {
+	if prefix == "" {
+		return key
+	}
+	return prefix + "." + key
+}
+
+func (d decoder) expandEnv(key string, value interface{}) (interface{}, error) {
+	switch value := value.(type) {
+	case string:
+		var err error
+		result := envRegex.ReplaceAllStringFunc(value, func(s string) string {
+			name := s[2 : len(s)-1]
+			env, ok := os.LookupEnv(name)
+			if !ok && err == nil {
+				err = d.errorf(key, "environment variable %s is not set", name)
+			}
+			return env
+		})
+		return result, err
+	case []interface{}:
+		result := make([]interface{}, len(value))
+		for i, elt := range value {
+			var err error
+			if result[i], err = d.expandEnv(fmt.Sprintf("%s[%d]", key, i), elt); err != nil {
+				return nil, err
+			}
+		}
+		return result, nil
+	case map[string]interface{}:
+		result := make(map[string]interface{}, len(value))
+		for k, elt := range value {
+			var err error
+			if result[k], err = d.expandEnv(joinKey(key, k), elt); err != nil {
+				return nil, err
+			}
+		}
+		return result, nil
+	case map[interface{}]interface{}:
+		result := make(map[string]interface{}, len(value))
+		for k, elt := range value {
+			ks := fmt.Sprint(k)
+			var err error
+			if result[ks], err = d.expandEnv(joinKey(key, ks), elt); err != nil {
+				return nil, err
+			}
+		}
+		return result, nil
+	}
+	return value, nil
+}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+func (d decoder) decode(key string, in interface{}, out reflect.Value) error {
+	if in == nil {
+		return nil
+	}
+	if out.Type() == durationType {
+		switch in := in.(type) {
+		case string:
+			dur, err := time.ParseDuration(in)
+			if err != nil {
+				return d.errorf(key, "invalid duration %q", in)
+			}
+			out.SetInt(int64(dur))
+			return nil
+		case int:
+			out.SetInt(int64(time.Duration(in) * time.Second))
+			return nil
+		}
+		return d.errorf(key, "expected a duration, got %s", describe(in))
+	}
+	switch out.Kind() {
+	case reflect.String:
+		if s, ok := in.(string); ok {
+			out.SetString(s)
+			return nil
+		}
+	case reflect.Bool:
+		if b, ok := in.(bool); ok {
+			out.SetBool(b)
+			return nil
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if i, ok := toInt(in); ok {
+			if out.OverflowInt(i) {
+				return d.errorf(key, "value %d is out of range", i)
+			}
+			out.SetInt(i)
+			return nil
+		}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if i, ok := toInt(in); ok {
+			if i < 0 || out.OverflowUint(uint64(i)) {
+				return d.errorf(key, "value %d is out of range", i)
+			}
+			out.SetUint(uint64(i))
+			return nil
+		}
+	case reflect.Float32, reflect.Float64:
+		switch in := in.(type) {
+		case float64:
+			out.SetFloat(in)
+			return nil
+		case int:
+			out.SetFloat(float64(in))
+			return nil
+		}
+	case reflect.Interface:
+		out.Set(reflect.ValueOf(in))
+		return nil
+	case reflect.Ptr:
+		elem := reflect.New(out.Type().Elem())
+		if err := d.decode(key, in, elem.Elem()); err != nil {
+			return err
+		}
+		out.Set(elem)
+		return nil
+	case reflect.Slice:
+		if list, ok := in.([]interface{}); ok {
+			result := reflect.MakeSlice(out.Type(), len(list), len(list))
+			for i, elt := range list {
+				if err := d.decode(fmt.Sprintf("%s[%d]", key, i), elt, result.Index(i)); err != nil {
+					return err
+				}
+			}
+			out.Set(result)
+			return nil
+		}
+		return d.errorf(key, "expected a list, got %s", describe(in))
+	case reflect.Map:
+		if out.Type().Key().Kind() != reflect.String {
+			panic(fmt.Sprintf("config for %s: maps must have string keys", d.section))
+		}
+		if m, ok := in.(map[string]interface{}); ok {
+			result := reflect.MakeMap(out.Type())
+			for k, elt := range m {
+				val := reflect.New(out.Type().Elem()).Elem()
+				if err := d.decode(joinKey(key, k), elt, val); err != nil {
+					return err
+				}
+				result.SetMapIndex(reflect.ValueOf(k).Convert(out.Type().Key()), val)
+			}
+			out.Set(result)
+			return nil
+		}
+		return d.errorf(key, "expected a mapping, got %s", describe(in))
+	case reflect.Struct:
+		if m, ok := in.(map[string]interface{}); ok {
+			return d.decodeStruct(key, m, out)
+		}
+		return d.errorf(key, "expected a mapping, got %s", describe(in))
+	default:
+		panic(fmt.Sprintf("config for %s: unsupported field type %s", d.section, out.Type()))
+	}
+	return d.errorf(key, "expected %s, got %s", out.Kind(), describe(in))
+}
+
+func (d decoder) decodeStruct(key string, in map[string]interface{}, out reflect.Value) error {
+	seen := make(map[string]bool, len(in))
+	t := out.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" {
+			// unexported
+			continue
+		}
+		name := strings.Split(field.Tag.Get("yaml"), ",")[0]
+		if name == "-" {
+			continue
+		} else if name == "" {
+			name = strings.ToLower(field.Name)
+		}
+		seen[name] = true
+		val, ok := in[name]
+		if !ok || val == nil {
+			if field.Tag.Get("config") == "required" {
+				return d.errorf(joinKey(key, name), "missing required value")
+			}
+			continue
+		}
+		if err := d.decode(joinKey(key, name), val, out.Field(i)); err != nil {
+			return err
+		}
+	}
+	for k := range in {
+		if !seen[k] {
+			fmt.Fprintf(os.Stderr, "warning: config for %s: unknown key %q\n", d.section, joinKey(key, k))
+		}
+	}
+	return nil
+}
+
+func toInt(in interface{}) (int64, bool) {
+	switch in := in.(type) {
+	case int:
+		return int64(in), true
+	case int64:
+		return in, true
+	case uint64:
+		return int64(in), in <= 1<<63-1
+	case float64:
+		if in == float64(int64(in)) {
+			return int64(in), true
+		}
+	}
+	return 0, false
+}
+
+func describe(in interface{}) string {
+	switch in := in.(type) {
+	case string:
+		return fmt.Sprintf("string %q", in)
+	case []interface{}:
+		return "a list"
+	case map[string]interface{}:
+		return "a mapping"
+	}
+	return fmt.Sprintf("%T %v", in, in)
+}
@@ -0,0 +1,164 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// checkIntegrity returns an error describing any problems found by SQLite's
+// integrity_check.
+func checkIntegrity(db *sql.DB) error {
+	rows, err := db.Query("PRAGMA integrity_check")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	var problems []string
+	for rows.Next() {
+		var msg string
+		if err := rows.Scan(&msg); err != nil {
+			return err
+		}
+		if msg != "ok" {
+			problems = append(problems, msg)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if len(problems) > 3 {
+		problems = append(problems[:3], fmt.Sprintf("and %d more", len(problems)-3))
+	}
+	if len(problems) > 0 {
+		return errors.New(strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// Backs up every sqlite3 database that has migrations registered to the
+// backup directory, then deletes the oldest backups of each beyond the number
+// to keep. Databases that don't exist yet are skipped. Returns the paths of
+// the new backups.
+//
+// The backups are made with VACUUM INTO, so they are consistent even while
+// the databases are in use.
+func Backup() ([]string, error) {
+	mutex.Lock()
+	c := config
+	paths := migrationPaths()
+	dir := c.BackupDir
+	if !filepath.IsAbs(dir) {
+		dir = filepath.Join(dataDir, dir)
+	}
+	mutex.Unlock()
+
+	if c.Driver != "sqlite3" {
+		return nil, fmt.Errorf("backups are only supported with the sqlite3 driver, not %s", c.Driver)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	stamp := time.Now().Format("20060102-150405")
+	var backups []string
+	for _, path := range paths {
+		resolved, err := resolvePath(c.Driver, path)
+		if err != nil {
+			return backups, err
+		}
+		if _, err := os.Stat(resolved); os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return backups, err
+		}
+		ext := filepath.Ext(resolved)
+		base := strings.TrimSuffix(filepath.Base(resolved), ext)
+		dest := filepath.Join(dir, base+"-"+stamp+ext)
+		if err := backup(resolved, dest); err != nil {
+			return backups, fmt.Errorf("%s: %v", path, err)
+		}
+		backups = append(backups, dest)
+		if err := rotate(filepath.Join(dir, base+"-*"+ext), c.BackupKeep); err != nil {
+			return backups, err
+		}
+	}
+	return backups, nil
+}
+
+// backup writes a copy of the database at path to dest. The copy is written
+// to a temporary file first so that a failed backup is never rotated in.
+func backup(path, dest string) error {
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	tmp := dest + ".tmp"
+	os.Remove(tmp)
+	if _, err := db.Exec("VACUUM INTO ?", tmp); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, dest)
+}
+
+// rotate deletes the oldest files matching pattern beyond the newest keep.
+// Backups are named by timestamp, so they sort oldest first.
+func rotate(pattern string, keep int) error {
+	matches, err := filepath.Glob(pattern)
+	if err != nil {
+		return err
+	}
+	sort.Strings(matches)
+	for len(matches) > keep {
+		if err := os.Remove(matches[0]); err != nil {
+			return err
+		}
+		matches = matches[1:]
+	}
+	return nil
+}
+
+var stopBackups chan struct{}
+
+// Starts backing up the databases periodically, if enabled by the
+// backup_interval config. This should be called after SetDataDir.
+func StartBackups() {
+	mutex.Lock()
+	defer mutex.Unlock()
+	if config.BackupInterval <= 0 || stopBackups != nil {
+		return
+	}
+	stopBackups = make(chan struct{})
+	go backupLoop(config.BackupInterval, stopBackups)
+}
+
+// Stops the periodic backups.
+func StopBackups() {
+	mutex.Lock()
+	defer mutex.Unlock()
+	if stopBackups != nil {
+		close(stopBackups)
+		stopBackups = nil
+	}
+}
+
+func backupLoop(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if _, err := Backup(); err != nil {
+				fmt.Fprintln(os.Stderr, "database: backup:", err)
+			}
+		case <-stop:
+			return
+		}
+	}
+}
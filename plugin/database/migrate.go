@@ -0,0 +1,218 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+)
+
+// A Migration is one step in the evolution of a database schema. Either the
+// SQL statements are executed in order, or Func is called with the name of
+// the driver. DriverSQL can give statements for particular drivers, which
+// are used instead of SQL. Each migration runs in its own transaction, so it
+// is either applied completely or not at all.
+type Migration struct {
+	Version     int
+	Description string
+	SQL         []string
+	DriverSQL   map[string][]string
+	Func        func(tx *sql.Tx, driver string) error
+}
+
+type migrationSet struct {
+	name       string
+	migrations []Migration
+}
+
+// registered migrations by database path, as passed to Open or OpenNamed
+var migrations = make(map[string][]*migrationSet)
+
+// Registers the migrations that create and update the tables owned by name
+// (typically a plugin name) in the database at path. Versions must be
+// positive and increasing. Pending migrations are applied when the database
+// is first opened, and the applied versions are recorded in the
+// schema_migrations table.
+//
+// This must be called from init().
+func RegisterMigrations(path, name string, ms ...Migration) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	for i, m := range ms {
+		if m.Version <= 0 || (i > 0 && m.Version <= ms[i-1].Version) {
+			panic(fmt.Sprintf("migrations for %s in %s: versions must be positive and increasing", name, path))
+		}
+	}
+	for _, set := range migrations[path] {
+		if set.name == name {
+			panic(fmt.Sprintf("migrations for %s in %s registered twice", name, path))
+		}
+	}
+	migrations[path] = append(migrations[path], &migrationSet{name: name, migrations: ms})
+}
+
+// A Pending migration has not yet been applied to a database.
+type Pending struct {
+	Path, Name string
+	Migration
+}
+
+// Returns the registered migrations that have not been applied to the
+// databases of the configured backend, in the order they would be applied,
+// without modifying any databases. Databases that don't exist yet have every
+// migration pending.
+func PendingMigrations() ([]Pending, error) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	var pending []Pending
+	for _, path := range migrationPaths() {
+		var db *sql.DB
+		if config.Driver == "sqlite3" {
+			resolved, err := resolvePath(config.Driver, path)
+			if err != nil {
+				return nil, err
+			}
+			if _, err := os.Stat(resolved); err == nil {
+				if db, err = sql.Open(config.Driver, resolved); err != nil {
+					return nil, err
+				}
+			} else if !os.IsNotExist(err) {
+				return nil, err
+			}
+		} else {
+			var err error
+			if db, err = sql.Open(postgresDriver, config.DSN); err != nil {
+				return nil, err
+			}
+		}
+		for _, set := range migrations[path] {
+			current := 0
+			if db != nil {
+				var err error
+				if current, err = currentVersion(db, config.Driver, set.name); err != nil {
+					db.Close()
+					return nil, fmt.Errorf("%s: %v", path, err)
+				}
+			}
+			for _, m := range set.migrations {
+				if m.Version > current {
+					pending = append(pending, Pending{Path: path, Name: set.name, Migration: m})
+				}
+			}
+		}
+		if db != nil {
+			db.Close()
+		}
+	}
+	return pending, nil
+}
+
+// Applies any pending migrations to every database of the configured backend
+// that has migrations registered, and returns the migrations that were
+// applied.
+func Migrate() ([]Pending, error) {
+	pending, err := PendingMigrations()
+	if err != nil {
+		return nil, err
+	}
+	mutex.Lock()
+	paths := migrationPaths()
+	mutex.Unlock()
+	for _, path := range paths {
+		db, err := OpenNamed(path)
+		if err != nil {
+			return nil, err
+		}
+		if err := Close(db); err != nil {
+			return nil, err
+		}
+	}
+	return pending, nil
+}
+
+// migrationPaths must be called with mutex locked.
+func migrationPaths() []string {
+	paths := make([]string, 0, len(migrations))
+	for path := range migrations {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// migrate applies the pending migrations registered for path. It must be
+// called with mutex locked.
+func migrate(db *sql.DB, driver, path string) error {
+	sets := migrations[path]
+	if len(sets) == 0 {
+		return nil
+	}
+	timeType := "datetime"
+	if driver == "postgres" {
+		timeType = "timestamptz"
+	}
+	sqlstr := "CREATE TABLE IF NOT EXISTS schema_migrations (name text not null, version integer not null, description text not null, applied " + timeType + " not null, primary key (name, version))"
+	if _, err := db.Exec(sqlstr); err != nil {
+		return err
+	}
+	for _, set := range sets {
+		current, err := currentVersion(db, driver, set.name)
+		if err != nil {
+			return err
+		}
+		for _, m := range set.migrations {
+			if m.Version <= current {
+				continue
+			}
+			if err := apply(db, driver, set.name, m); err != nil {
+				return fmt.Errorf("migration %d of %s (%s): %v", m.Version, set.name, m.Description, err)
+			}
+		}
+	}
+	return nil
+}
+
+func currentVersion(db *sql.DB, driver, name string) (int, error) {
+	sqlstr := "SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'schema_migrations'"
+	if driver == "postgres" {
+		sqlstr = "SELECT COUNT(*) FROM information_schema.tables WHERE table_schema = current_schema() AND table_name = 'schema_migrations'"
+	}
+	var count int
+	if err := db.QueryRow(sqlstr).Scan(&count); err != nil || count == 0 {
+		return 0, err
+	}
+	var version sql.NullInt64
+	err := db.QueryRow("SELECT MAX(version) FROM schema_migrations WHERE name = ?", name).Scan(&version)
+	return int(version.Int64), err
+}
+
+func apply(db *sql.DB, driver, name string, m Migration) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	if m.Func != nil {
+		err = m.Func(tx, driver)
+	} else {
+		sqls := m.SQL
+		if driverSQL, ok := m.DriverSQL[driver]; ok {
+			sqls = driverSQL
+		}
+		for _, sqlstr := range sqls {
+			if _, err = tx.Exec(sqlstr); err != nil {
+				break
+			}
+		}
+	}
+	if err == nil {
+		sqlstr := "INSERT INTO schema_migrations (name, version, description, applied) VALUES (?, ?, ?, ?)"
+		_, err = tx.Exec(sqlstr, name, m.Version, m.Description, time.Now())
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
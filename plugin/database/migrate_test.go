@@ -0,0 +1,166 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func migrateTestDir(t *testing.T) func() {
+	dir, err := ioutil.TempDir("", "migrate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	SetDataDir(dir)
+	return func() {
+		SetDataDir(".")
+		os.RemoveAll(dir)
+	}
+}
+
+func tableExists(t *testing.T, db *sql.DB, table string) bool {
+	var count int
+	err := db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = ?", table).Scan(&count)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return count > 0
+}
+
+func versions(t *testing.T, db *sql.DB, name string) []int {
+	rs, err := db.Query("SELECT version FROM schema_migrations WHERE name = ? ORDER BY version", name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rs.Close()
+	var vs []int
+	for rs.Next() {
+		var v int
+		if err := rs.Scan(&v); err != nil {
+			t.Fatal(err)
+		}
+		vs = append(vs, v)
+	}
+	return vs
+}
+
+func TestMigrationsApply(t *testing.T) {
+	defer migrateTestDir(t)()
+
+	calls := 0
+	RegisterMigrations("apply.db", "a",
+		Migration{Version: 1, Description: "create a", SQL: []string{
+			"CREATE TABLE a (x integer)",
+		}},
+		Migration{Version: 3, Description: "add y to a", Func: func(tx *sql.Tx, driver string) error {
+			calls++
+			_, err := tx.Exec("ALTER TABLE a ADD COLUMN y text")
+			return err
+		}},
+	)
+	db, err := Open("sqlite3", "apply.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("INSERT INTO a (x, y) VALUES (1, 'one')"); err != nil {
+		t.Errorf("table a wasn't migrated: %v", err)
+	}
+	if got := versions(t, db, "a"); len(got) != 2 || got[0] != 1 || got[1] != 3 {
+		t.Errorf("versions of a = %v, want [1 3]", got)
+	}
+	if err := Close(db); err != nil {
+		t.Fatal(err)
+	}
+
+	// re-opening applies only what has been registered since
+	RegisterMigrations("apply.db", "b",
+		Migration{Version: 1, Description: "create b", SQL: []string{
+			"CREATE TABLE b (x integer)",
+		}},
+	)
+	db, err = Open("sqlite3", "apply.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer Close(db)
+	if calls != 1 {
+		t.Errorf("migration 3 of a ran %d times, want 1", calls)
+	}
+	if !tableExists(t, db, "b") {
+		t.Error("table b wasn't created")
+	}
+	if got := versions(t, db, "b"); len(got) != 1 || got[0] != 1 {
+		t.Errorf("versions of b = %v, want [1]", got)
+	}
+}
+
+func TestMigrationsRollback(t *testing.T) {
+	defer migrateTestDir(t)()
+
+	tests := []struct {
+		path string
+		m    Migration
+	}{
+		{"badsql.db", Migration{Version: 2, Description: "bad sql", SQL: []string{
+			"CREATE TABLE two (x integer)",
+			"INSERT INTO missing VALUES (1)",
+		}}},
+		{"badfunc.db", Migration{Version: 2, Description: "bad func", Func: func(tx *sql.Tx, driver string) error {
+			if _, err := tx.Exec("CREATE TABLE two (x integer)"); err != nil {
+				return err
+			}
+			return errors.New("failed")
+		}}},
+	}
+	for _, test := range tests {
+		RegisterMigrations(test.path, "r",
+			Migration{Version: 1, Description: "create one", SQL: []string{
+				"CREATE TABLE one (x integer)",
+			}},
+			test.m,
+		)
+		if db, err := Open("sqlite3", test.path); err == nil {
+			Close(db)
+			t.Errorf("%s: opened despite a failed migration", test.path)
+			continue
+		}
+		if err := Clear("sqlite3", test.path); err != nil {
+			t.Fatal(err)
+		}
+
+		pending, err := PendingMigrations()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var pendingVersions []int
+		for _, p := range pending {
+			if p.Path == test.path {
+				pendingVersions = append(pendingVersions, p.Version)
+			}
+		}
+		if len(pendingVersions) != 1 || pendingVersions[0] != 2 {
+			t.Errorf("%s: pending versions = %v, want [2]", test.path, pendingVersions)
+		}
+
+		path, err := resolvePath("sqlite3", test.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		db, err := sql.Open("sqlite3", path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !tableExists(t, db, "one") {
+			t.Errorf("%s: migration 1 wasn't kept", test.path)
+		}
+		if tableExists(t, db, "two") {
+			t.Errorf("%s: failed migration wasn't rolled back", test.path)
+		}
+		if got := versions(t, db, "r"); len(got) != 1 || got[0] != 1 {
+			t.Errorf("%s: versions = %v, want [1]", test.path, got)
+		}
+		db.Close()
+	}
+}
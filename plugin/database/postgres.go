@@ -0,0 +1,63 @@
+package database
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"github.com/lib/pq"
+	"strconv"
+	"strings"
+)
+
+// postgres databases are opened with a wrapper around lib/pq that rewrites
+// the ? placeholders used throughout the plugins into $1, $2, etc.
+const postgresDriver = "voidbot-postgres"
+
+func init() {
+	sql.Register(postgresDriver, pgDriver{})
+}
+
+type pgDriver struct{}
+
+func (pgDriver) Open(dsn string) (driver.Conn, error) {
+	conn, err := pq.Open(dsn)
+	if err != nil {
+		return nil, err
+	}
+	return pgConn{conn}, nil
+}
+
+// pgConn only exposes the basic driver.Conn methods, so that database/sql
+// prepares every query through Prepare.
+type pgConn struct {
+	driver.Conn
+}
+
+func (c pgConn) Prepare(query string) (driver.Stmt, error) {
+	return c.Conn.Prepare(rebind(query))
+}
+
+// rebind replaces each ? outside of quotes with a numbered placeholder.
+func rebind(query string) string {
+	if !strings.Contains(query, "?") {
+		return query
+	}
+	var buf strings.Builder
+	n := 0
+	var quote rune
+	for _, r := range query {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			}
+		case r == '\'' || r == '"':
+			quote = r
+		case r == '?':
+			n++
+			buf.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		buf.WriteRune(r)
+	}
+	return buf.String()
+}
@@ -0,0 +1,242 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// A Writer applies writes to a database on its own goroutine, so that
+// callbacks don't wait on disk I/O. Writes are queued and committed in
+// batches, one transaction per batch, when the batch is full or the flush
+// interval has passed. If the queue is full, Write blocks until there's room,
+// which is counted in the writer's stats.
+//
+// If a batch fails, its writes are retried one per transaction so that a
+// single bad write doesn't lose the others. Failed writes are logged. As a
+// write may be run more than once, it must not have side effects outside the
+// transaction; use WriteThen for anything that should happen once it's
+// committed.
+type Writer struct {
+	name      string
+	db        *sql.DB
+	batchSize int
+	interval  time.Duration
+	queue     chan write
+	done      chan struct{}
+
+	closeLock sync.RWMutex
+	closed    bool
+
+	stats struct {
+		sync.Mutex
+		WriterStats
+	}
+}
+
+// WriterStats counts the work done by a Writer.
+type WriterStats struct {
+	Name string
+	// Writes queued or in the batch being written
+	Pending int
+	// The size of the queue
+	Capacity int
+	Written  uint64
+	Failed   uint64
+	Batches  uint64
+	// Writes that had to wait for room in the queue, and the total wait
+	Blocked     uint64
+	BlockedTime time.Duration
+	// How long the last batch took to commit
+	LastFlush time.Duration
+}
+
+type write struct {
+	f    func(tx *sql.Tx) error
+	then func()
+}
+
+// ErrWriterClosed is returned by Write after the writer is closed.
+var ErrWriterClosed = errors.New("database: writer is closed")
+
+var writers struct {
+	sync.Mutex
+	byName map[string]*Writer
+}
+
+func init() {
+	writers.byName = make(map[string]*Writer)
+}
+
+// Returns a writer for db named name (typically the plugin name), which
+// commits up to batchSize writes at a time, at least every interval. The
+// writer must be closed with Close before the database is.
+func NewWriter(name string, db *sql.DB, batchSize int, interval time.Duration) *Writer {
+	if batchSize <= 0 {
+		batchSize = 1
+	}
+	w := &Writer{
+		name:      name,
+		db:        db,
+		batchSize: batchSize,
+		interval:  interval,
+		queue:     make(chan write, 4*batchSize),
+		done:      make(chan struct{}),
+	}
+	w.stats.Name = name
+	w.stats.Capacity = cap(w.queue)
+	writers.Lock()
+	writers.byName[name] = w
+	writers.Unlock()
+	go w.run()
+	return w
+}
+
+// Queues f to be called in a transaction. If f returns an error, the
+// transaction is rolled back.
+func (w *Writer) Write(f func(tx *sql.Tx) error) error {
+	return w.WriteThen(f, nil)
+}
+
+// Like Write, but then is called on the writer's goroutine once f's
+// transaction has been committed. It isn't called if the write fails.
+func (w *Writer) WriteThen(f func(tx *sql.Tx) error, then func()) error {
+	w.closeLock.RLock()
+	defer w.closeLock.RUnlock()
+	if w.closed {
+		return ErrWriterClosed
+	}
+	w.stats.Lock()
+	w.stats.Pending++
+	w.stats.Unlock()
+	wr := write{f, then}
+	select {
+	case w.queue <- wr:
+	default:
+		start := time.Now()
+		w.queue <- wr
+		w.stats.Lock()
+		w.stats.Blocked++
+		w.stats.BlockedTime += time.Since(start)
+		w.stats.Unlock()
+	}
+	return nil
+}
+
+// Waits for every queued write to be committed, then stops the writer.
+func (w *Writer) Close() {
+	w.closeLock.Lock()
+	if !w.closed {
+		w.closed = true
+		close(w.queue)
+	}
+	w.closeLock.Unlock()
+	<-w.done
+	writers.Lock()
+	if writers.byName[w.name] == w {
+		delete(writers.byName, w.name)
+	}
+	writers.Unlock()
+}
+
+// Returns the writer's current stats.
+func (w *Writer) Stats() WriterStats {
+	w.stats.Lock()
+	defer w.stats.Unlock()
+	return w.stats.WriterStats
+}
+
+// Returns the stats of every open writer, sorted by name.
+func Stats() []WriterStats {
+	writers.Lock()
+	defer writers.Unlock()
+	stats := make([]WriterStats, 0, len(writers.byName))
+	for _, w := range writers.byName {
+		stats = append(stats, w.Stats())
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Name < stats[j].Name })
+	return stats
+}
+
+func (w *Writer) run() {
+	defer close(w.done)
+	var ticks <-chan time.Time
+	if w.interval > 0 {
+		ticker := time.NewTicker(w.interval)
+		defer ticker.Stop()
+		ticks = ticker.C
+	}
+	var batch []write
+	for {
+		select {
+		case wr, ok := <-w.queue:
+			if !ok {
+				w.flush(batch)
+				return
+			}
+			batch = append(batch, wr)
+			if len(batch) >= w.batchSize {
+				w.flush(batch)
+				batch = nil
+			}
+		case <-ticks:
+			w.flush(batch)
+			batch = nil
+		}
+	}
+}
+
+func (w *Writer) flush(batch []write) {
+	if len(batch) == 0 {
+		return
+	}
+	start := time.Now()
+	var committed []write
+	if err := w.apply(batch...); err == nil {
+		committed = batch
+	} else {
+		// find the bad writes
+		for _, wr := range batch {
+			if err := w.apply(wr); err != nil {
+				fmt.Fprintf(os.Stderr, "database: %s: write failed: %v\n", w.name, err)
+			} else {
+				committed = append(committed, wr)
+			}
+		}
+	}
+	failed := len(batch) - len(committed)
+	w.recordFlush(len(batch), failed, time.Since(start))
+	for _, wr := range committed {
+		if wr.then != nil {
+			wr.then()
+		}
+	}
+}
+
+func (w *Writer) recordFlush(n, failed int, elapsed time.Duration) {
+	w.stats.Lock()
+	defer w.stats.Unlock()
+	w.stats.Pending -= n
+	w.stats.Written += uint64(n - failed)
+	w.stats.Failed += uint64(failed)
+	w.stats.Batches++
+	w.stats.LastFlush = elapsed
+}
+
+func (w *Writer) apply(batch ...write) error {
+	tx, err := w.db.Begin()
+	if err != nil {
+		return err
+	}
+	for _, wr := range batch {
+		if err := wr.f(tx); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,135 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func openWriterDB(t *testing.T) (*sql.DB, func()) {
+	dir, err := ioutil.TempDir("", "writer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := sql.Open("sqlite3", filepath.Join(dir, "writer.db"))
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("CREATE TABLE t (n integer primary key)"); err != nil {
+		db.Close()
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return db, func() {
+		db.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func insert(n int) func(tx *sql.Tx) error {
+	return func(tx *sql.Tx) error {
+		_, err := tx.Exec("INSERT INTO t (n) VALUES (?)", n)
+		return err
+	}
+}
+
+func rows(t *testing.T, db *sql.DB) []int {
+	rs, err := db.Query("SELECT n FROM t ORDER BY n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rs.Close()
+	var ns []int
+	for rs.Next() {
+		var n int
+		if err := rs.Scan(&n); err != nil {
+			t.Fatal(err)
+		}
+		ns = append(ns, n)
+	}
+	return ns
+}
+
+func TestWriterBatchFallback(t *testing.T) {
+	db, cleanup := openWriterDB(t)
+	defer cleanup()
+
+	w := NewWriter("test", db, 4, 0)
+	var then []int
+	for _, n := range []int{1, 2, 3, 4} {
+		n := n
+		f := insert(n)
+		if n == 3 {
+			f = func(tx *sql.Tx) error { return errors.New("bad write") }
+		}
+		if err := w.WriteThen(f, func() { then = append(then, n) }); err != nil {
+			t.Fatal(err)
+		}
+	}
+	w.Close()
+
+	if got, want := rows(t, db), []int{1, 2, 4}; !reflect.DeepEqual(got, want) {
+		t.Errorf("rows = %v, want %v", got, want)
+	}
+	if want := []int{1, 2, 4}; !reflect.DeepEqual(then, want) {
+		t.Errorf("then called for %v, want %v", then, want)
+	}
+	stats := w.Stats()
+	if stats.Written != 3 || stats.Failed != 1 || stats.Pending != 0 {
+		t.Errorf("stats = %+v, want 3 written, 1 failed, 0 pending", stats)
+	}
+}
+
+func TestWriterThenAfterCommit(t *testing.T) {
+	db, cleanup := openWriterDB(t)
+	defer cleanup()
+
+	w := NewWriter("test", db, 2, 0)
+	var seen [][]int
+	for n := 1; n <= 4; n++ {
+		if err := w.WriteThen(insert(n), func() { seen = append(seen, rows(t, db)) }); err != nil {
+			t.Fatal(err)
+		}
+	}
+	w.Close()
+
+	// each batch is committed before its callbacks run, in the order queued
+	want := [][]int{{1, 2}, {1, 2}, {1, 2, 3, 4}, {1, 2, 3, 4}}
+	if !reflect.DeepEqual(seen, want) {
+		t.Errorf("rows seen by then = %v, want %v", seen, want)
+	}
+}
+
+func TestWriterCloseDrains(t *testing.T) {
+	db, cleanup := openWriterDB(t)
+	defer cleanup()
+
+	// nothing is flushed until Close, as neither the batch nor the
+	// interval is reached
+	w := NewWriter("test", db, 100, time.Hour)
+	for n := 1; n <= 10; n++ {
+		if err := w.Write(insert(n)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := len(Stats()); got != 1 {
+		t.Errorf("%d open writers, want 1", got)
+	}
+	w.Close()
+
+	if got := len(rows(t, db)); got != 10 {
+		t.Errorf("%d rows after Close, want 10", got)
+	}
+	if err := w.Write(insert(11)); err != ErrWriterClosed {
+		t.Errorf("Write after Close = %v, want ErrWriterClosed", err)
+	}
+	if got := len(Stats()); got != 0 {
+		t.Errorf("%d open writers after Close, want 0", got)
+	}
+}
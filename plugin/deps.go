@@ -0,0 +1,147 @@
+package plugin
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// resolvePlugins determines which plugins should be loaded and the order in
+// which to initialize them. If plugins is nil, every plugin is loaded.
+// Otherwise the listed plugins are loaded, along with any unnamed plugins and
+// any plugins needed to satisfy the Depends and Requires of loaded plugins.
+// The result is sorted so that every plugin comes after the plugins it
+// depends on and the plugins providing the events it requires. Any plugins
+// that were enabled automatically are described in notes.
+//
+// pluginState must be locked by the caller.
+func resolvePlugins(plugins []string) (order []*Plugin, notes []string, err error) {
+	byName := make(map[string]*Plugin, len(pluginState.Plugins))
+	providers := make(map[string][]*Plugin)
+	for _, plugin := range pluginState.Plugins {
+		if plugin.Name != "" {
+			byName[plugin.Name] = plugin
+		}
+		for _, event := range plugin.Callbacks.Provides {
+			providers[event] = append(providers[event], plugin)
+		}
+	}
+
+	enabled := make(map[*Plugin]bool, len(pluginState.Plugins))
+	for _, plugin := range pluginState.Plugins {
+		if plugins == nil || plugin.Name == "" {
+			enabled[plugin] = true
+		}
+	}
+	for _, name := range plugins {
+		plugin := byName[name]
+		if plugin == nil {
+			return nil, nil, fmt.Errorf("unknown plugin %q", name)
+		}
+		enabled[plugin] = true
+	}
+
+	// enable missing dependencies until nothing changes
+	for changed := true; changed; {
+		changed = false
+		for _, plugin := range pluginState.Plugins {
+			if !enabled[plugin] {
+				continue
+			}
+			for _, name := range plugin.Callbacks.Depends {
+				dep := byName[name]
+				if dep == nil {
+					return nil, nil, fmt.Errorf("plugin %q depends on unknown plugin %q", plugin.Name, name)
+				}
+				if !enabled[dep] {
+					notes = append(notes, fmt.Sprintf("enabling plugin %q, needed by plugin %q", dep.Name, plugin.Name))
+					enabled[dep] = true
+					changed = true
+				}
+			}
+			for _, event := range plugin.Callbacks.Requires {
+				candidates := providers[event]
+				if len(candidates) == 0 {
+					return nil, nil, fmt.Errorf("plugin %q requires event %s, which no plugin provides", plugin.Name, event)
+				}
+				found := false
+				for _, provider := range candidates {
+					if enabled[provider] {
+						found = true
+						break
+					}
+				}
+				if !found {
+					provider := candidates[0]
+					notes = append(notes, fmt.Sprintf("enabling plugin %q to provide %s events for plugin %q", provider.Name, event, plugin.Name))
+					enabled[provider] = true
+					changed = true
+				}
+			}
+		}
+	}
+
+	// build the dependency graph among enabled plugins
+	index := make(map[*Plugin]int, len(pluginState.Plugins))
+	for i, plugin := range pluginState.Plugins {
+		index[plugin] = i
+	}
+	after := make(map[*Plugin][]*Plugin)
+	pending := make(map[*Plugin]int)
+	addEdge := func(from, to *Plugin) {
+		if from == to {
+			return
+		}
+		after[from] = append(after[from], to)
+		pending[to]++
+	}
+	for _, plugin := range pluginState.Plugins {
+		if !enabled[plugin] {
+			continue
+		}
+		for _, name := range plugin.Callbacks.Depends {
+			addEdge(byName[name], plugin)
+		}
+		for _, event := range plugin.Callbacks.Requires {
+			for _, provider := range providers[event] {
+				if enabled[provider] {
+					addEdge(provider, plugin)
+				}
+			}
+		}
+	}
+
+	// topological sort, preferring registration order among ready plugins
+	var ready []*Plugin
+	for _, plugin := range pluginState.Plugins {
+		if enabled[plugin] && pending[plugin] == 0 {
+			ready = append(ready, plugin)
+		}
+	}
+	for len(ready) > 0 {
+		plugin := ready[0]
+		ready = ready[1:]
+		order = append(order, plugin)
+		added := false
+		for _, next := range after[plugin] {
+			pending[next]--
+			if pending[next] == 0 {
+				ready = append(ready, next)
+				added = true
+			}
+		}
+		if added {
+			sort.Slice(ready, func(i, j int) bool { return index[ready[i]] < index[ready[j]] })
+		}
+	}
+	if len(order) != len(enabled) {
+		var cycle []string
+		for _, plugin := range pluginState.Plugins {
+			if enabled[plugin] && pending[plugin] > 0 {
+				cycle = append(cycle, fmt.Sprintf("%q", plugin.Name))
+			}
+		}
+		return nil, nil, fmt.Errorf("dependency cycle among plugins %s", strings.Join(cycle, ", "))
+	}
+	return order, notes, nil
+}
@@ -0,0 +1,79 @@
+package plugin
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestResolvePlugins(t *testing.T) {
+	registered := []*Plugin{
+		{Name: "youtube", Callbacks: Callbacks{Requires: []string{"URL"}}},
+		{Name: "urlevent", Callbacks: Callbacks{Requires: []string{"PRIVMSG"}, Provides: []string{"URL"}}},
+		{Name: "command", Callbacks: Callbacks{Provides: []string{"PRIVMSG", "COMMAND"}}},
+		{Name: "urls", Callbacks: Callbacks{Depends: []string{"cache"}, Requires: []string{"URL", "COMMAND"}}},
+		{Name: "cache"},
+		{Name: "stocks", Callbacks: Callbacks{Requires: []string{"COMMAND"}}},
+	}
+
+	tests := []struct {
+		plugins []string
+		order   string // the names in init order
+		notes   int
+		err     string
+	}{
+		{nil, "command urlevent youtube cache urls stocks", 0, ""},
+		{[]string{"stocks"}, "command stocks", 1, ""},
+		{[]string{"youtube"}, "command urlevent youtube", 2, ""},
+		{[]string{"youtube", "urlevent", "command"}, "command urlevent youtube", 0, ""},
+		{[]string{"urls"}, "command urlevent cache urls", 3, ""},
+		{[]string{"nope"}, "", 0, `unknown plugin "nope"`},
+	}
+
+	defer func(plugins []*Plugin) { pluginState.Plugins = plugins }(pluginState.Plugins)
+	pluginState.Plugins = registered
+	for _, test := range tests {
+		order, notes, err := resolvePlugins(test.plugins)
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("resolvePlugins(%q): got error %v, want %q", test.plugins, err, test.err)
+			}
+			continue
+		} else if err != nil {
+			t.Errorf("resolvePlugins(%q): %v", test.plugins, err)
+			continue
+		}
+		var names []string
+		for _, plugin := range order {
+			names = append(names, plugin.Name)
+		}
+		if got := strings.Join(names, " "); got != test.order {
+			t.Errorf("resolvePlugins(%q) = %s, want %s", test.plugins, got, test.order)
+		}
+		if len(notes) != test.notes {
+			t.Errorf("resolvePlugins(%q) notes = %q, want %d", test.plugins, notes, test.notes)
+		}
+	}
+}
+
+func TestResolvePluginsErrors(t *testing.T) {
+	tests := []struct {
+		registered []*Plugin
+		err        string
+	}{
+		{[]*Plugin{{Name: "a", Callbacks: Callbacks{Depends: []string{"b"}}}}, `depends on unknown plugin "b"`},
+		{[]*Plugin{{Name: "a", Callbacks: Callbacks{Requires: []string{"URL"}}}}, "requires event URL, which no plugin provides"},
+		{[]*Plugin{
+			{Name: "a", Callbacks: Callbacks{Depends: []string{"b"}}},
+			{Name: "b", Callbacks: Callbacks{Requires: []string{"A"}}},
+			{Name: "c", Callbacks: Callbacks{Provides: []string{"A"}, Depends: []string{"a"}}},
+		}, "dependency cycle"},
+	}
+
+	defer func(plugins []*Plugin) { pluginState.Plugins = plugins }(pluginState.Plugins)
+	for _, test := range tests {
+		pluginState.Plugins = test.registered
+		if _, _, err := resolvePlugins(nil); err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("got error %v, want %q", err, test.err)
+		}
+	}
+}
@@ -3,25 +3,32 @@ package dogecoin
 import (
 	"../"
 	"../../utils"
+	"../store"
 	"fmt"
 	"github.com/kballard/gocallback/callback"
 	"github.com/kballard/goirc/irc"
 	"math"
 	"math/rand"
+	"os"
 	"regexp"
 	"strconv"
 	"strings"
 )
 
 func init() {
-	plugin.RegisterPlugin("dogecoin", plugin.Callbacks{Init: setup})
+	plugin.RegisterPlugin("dogecoin", plugin.Callbacks{Init: setup, Requires: []string{"COMMAND", "PRIVMSG"}})
 }
 
 var enabled = false
 
+var kv = store.New("dogecoin")
+
 var btcRegex = regexp.MustCompile("(?i)(\\d+(?:\\.\\d*)?|\\.\\d+) ?btcs?\\b")
 
 func setup(reg *callback.Registry, config map[string]interface{}) error {
+	if _, err := kv.Get("enabled", &enabled); err != nil {
+		return err
+	}
 	reg.AddCallback("COMMAND", func(conn *irc.Conn, line irc.Line, cmd string, arg string, reply string, isPrivate bool) {
 		if cmd == "dogecoin" && !isPrivate {
 			arg = strings.ToLower(strings.TrimSpace(arg))
@@ -36,12 +43,16 @@ func setup(reg *callback.Registry, config map[string]interface{}) error {
 			} else if arg == "on" || arg == "off" {
 				if line.Src.Nick == "Me1000" {
 					plugin.Conn(conn).Notice(reply, "no")
-				} else if arg == "on" {
-					enabled = true
-					plugin.Conn(conn).Notice(reply, "dogecoin enabled")
-				} else if arg == "off" {
-					enabled = false
-					plugin.Conn(conn).Notice(reply, "dogecoin disabled")
+				} else {
+					enabled = arg == "on"
+					if err := kv.Set("enabled", enabled); err != nil {
+						fmt.Fprintln(os.Stderr, "dogecoin:", err)
+					}
+					if enabled {
+						plugin.Conn(conn).Notice(reply, "dogecoin enabled")
+					} else {
+						plugin.Conn(conn).Notice(reply, "dogecoin disabled")
+					}
 				}
 			} else {
 				plugin.Conn(conn).Notice(reply, "derp?")
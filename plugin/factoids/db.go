@@ -0,0 +1,130 @@
+package factoids
+
+import (
+	"../database"
+	"database/sql"
+	"time"
+)
+
+// Global factoids are stored with an empty channel.
+const global = ""
+
+// Revision actions
+const (
+	actionLearn  = "learn"
+	actionEdit   = "edit"
+	actionForget = "forget"
+)
+
+type factoid struct {
+	channel string
+	key     string
+	value   string
+	creator string
+	created time.Time
+}
+
+// A revision is an entry in the edit history of a factoid.
+type revision struct {
+	channel   string
+	key       string
+	value     string
+	nick      string
+	timestamp time.Time
+	action    string
+}
+
+// find returns the factoid key in channel, or the global one if the channel
+// has none.
+func find(db *sql.DB, channel, key string) (*factoid, error) {
+	var f factoid
+	row := db.QueryRow("SELECT channel, key, value, creator, created FROM factoids WHERE key = ? AND channel IN (?, ?) ORDER BY channel DESC LIMIT 1", key, channel, global)
+	if err := row.Scan(&f.channel, &f.key, &f.value, &f.creator, &f.created); err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return &f, nil
+}
+
+// learn sets key in channel to value, returning the previous value if there
+// was one.
+func learn(db *sql.DB, channel, key, value, nick string, now time.Time) (string, bool, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return "", false, err
+	}
+	defer tx.Rollback()
+
+	var id int64
+	var old string
+	action := actionEdit
+	err = tx.QueryRow("SELECT id, value FROM factoids WHERE channel = ? AND key = ?", channel, key).Scan(&id, &old)
+	if err == sql.ErrNoRows {
+		action = actionLearn
+		_, err = database.Insert(tx, "INSERT INTO factoids (channel, key, value, creator, created) VALUES (?, ?, ?, ?, ?)", channel, key, value, nick, now)
+	} else if err == nil {
+		_, err = tx.Exec("UPDATE factoids SET value = ? WHERE id = ?", value, id)
+	}
+	if err != nil {
+		return "", false, err
+	}
+	if err := addRevision(tx, revision{channel, key, value, nick, now, action}); err != nil {
+		return "", false, err
+	}
+	return old, action == actionEdit, tx.Commit()
+}
+
+// forget deletes key from channel, returning false if it didn't exist. The
+// forgotten value is kept in the history.
+func forget(db *sql.DB, channel, key, nick string, now time.Time) (bool, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	var id int64
+	var value string
+	err = tx.QueryRow("SELECT id, value FROM factoids WHERE channel = ? AND key = ?", channel, key).Scan(&id, &value)
+	if err == sql.ErrNoRows {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	if _, err := tx.Exec("DELETE FROM factoids WHERE id = ?", id); err != nil {
+		return false, err
+	}
+	if err := addRevision(tx, revision{channel, key, value, nick, now, actionForget}); err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+func addRevision(tx *sql.Tx, r revision) error {
+	_, err := tx.Exec("INSERT INTO factoid_history (channel, key, value, nick, timestamp, action) VALUES (?, ?, ?, ?, ?, ?)", r.channel, r.key, r.value, r.nick, r.timestamp, r.action)
+	return err
+}
+
+// history returns the most recent n revisions of key in channel, newest
+// first, along with the total number of revisions.
+func history(db *sql.DB, channel, key string, n int) ([]revision, int, error) {
+	var count int
+	if err := db.QueryRow("SELECT COUNT(*) FROM factoid_history WHERE channel = ? AND key = ?", channel, key).Scan(&count); err != nil {
+		return nil, 0, err
+	}
+	rows, err := db.Query("SELECT channel, key, value, nick, timestamp, action FROM factoid_history WHERE channel = ? AND key = ? ORDER BY id DESC LIMIT ?", channel, key, n)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+	var revisions []revision
+	for rows.Next() {
+		var r revision
+		if err := rows.Scan(&r.channel, &r.key, &r.value, &r.nick, &r.timestamp, &r.action); err != nil {
+			return nil, 0, err
+		}
+		revisions = append(revisions, r)
+	}
+	return revisions, count, rows.Err()
+}
@@ -0,0 +1,313 @@
+package factoids
+
+import (
+	"../"
+	"../../utils"
+	"../command"
+	"../database"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/kballard/gocallback/callback"
+	"github.com/kballard/goirc/irc"
+	"strings"
+	"time"
+)
+
+func init() {
+	database.RegisterMigrations("factoids.db", "factoids",
+		database.Migration{Version: 1, Description: "create factoids tables", SQL: []string{
+			"CREATE TABLE IF NOT EXISTS factoids (id integer not null primary key, channel text not null, key text not null, value text not null, creator text not null, created datetime not null)",
+			"CREATE UNIQUE INDEX IF NOT EXISTS factoid_key_idx ON factoids (channel, key)",
+			"CREATE TABLE IF NOT EXISTS factoid_history (id integer not null primary key, channel text not null, key text not null, value text not null, nick text not null, timestamp datetime not null, action text not null)",
+			"CREATE INDEX IF NOT EXISTS factoid_history_idx ON factoid_history (channel, key)",
+		}, DriverSQL: map[string][]string{"postgres": {
+			"CREATE TABLE IF NOT EXISTS factoids (id bigserial not null primary key, channel text not null, key text not null, value text not null, creator text not null, created timestamptz not null)",
+			"CREATE UNIQUE INDEX IF NOT EXISTS factoid_key_idx ON factoids (channel, key)",
+			"CREATE TABLE IF NOT EXISTS factoid_history (id bigserial not null primary key, channel text not null, key text not null, value text not null, nick text not null, timestamp timestamptz not null, action text not null)",
+			"CREATE INDEX IF NOT EXISTS factoid_history_idx ON factoid_history (channel, key)",
+		}}},
+	)
+	plugin.RegisterPlugin("factoids", plugin.Callbacks{Init: setup, Teardown: teardown, Config: &config, Requires: []string{"COMMAND", "PRIVMSG", "WHISPER"}})
+}
+
+var config = factoidsConfig{
+	Prefix:         "?",
+	MaxKeyLength:   64,
+	MaxValueLength: 400,
+}
+
+type factoidsConfig struct {
+	// Factoids are looked up with this followed by the key, e.g. ?foo
+	Prefix string `yaml:"prefix"`
+	// Longer keys and values can't be learned
+	MaxKeyLength   int `yaml:"max_key_length"`
+	MaxValueLength int `yaml:"max_value_length"`
+	// Only these users may learn and forget global factoids
+	Trusted []string `yaml:"trusted"`
+
+	trusted utils.Hostmasks
+}
+
+func (c *factoidsConfig) Validate() error {
+	if c.Prefix == "" {
+		return errors.New("prefix must not be empty")
+	} else if c.MaxKeyLength <= 0 || c.MaxValueLength <= 0 {
+		return errors.New("lengths must be positive")
+	}
+	var err error
+	if c.trusted, err = utils.CompileHostmasks(c.Trusted); err != nil {
+		return fmt.Errorf("trusted: %v", err)
+	}
+	return nil
+}
+
+// how many revisions !facthistory shows
+const maxRevisions = 5
+
+const timeFormat = "2006-01-02 15:04"
+
+var factoidsDB *sql.DB
+
+func setup(reg *callback.Registry, _ map[string]interface{}) error {
+	db, err := database.OpenNamed("factoids.db")
+	if err != nil {
+		return err
+	}
+	factoidsDB = db
+
+	reg.AddCallback("PRIVMSG", func(conn *irc.Conn, line irc.Line, dst, text string) {
+		handleLookup(conn, line, dst, text)
+	})
+	reg.AddCallback("WHISPER", func(conn *irc.Conn, line irc.Line, text string) {
+		handleLookup(conn, line, line.Src.Nick, text)
+	})
+	reg.AddCallback("COMMAND", func(conn *irc.Conn, line irc.Line, cmd, arg, reply string, isPrivate bool) {
+		switch cmd {
+		case "learn":
+			handleLearn(conn, line, arg, reply, isPrivate)
+		case "forget":
+			handleForget(conn, line, arg, reply, isPrivate)
+		case "factinfo":
+			handleInfo(conn, line, arg, reply, isPrivate)
+		case "facthistory":
+			handleHistory(conn, line, arg, reply, isPrivate)
+		}
+	})
+	return nil
+}
+
+func teardown() error {
+	if factoidsDB == nil {
+		return nil
+	}
+	err := database.Close(factoidsDB)
+	factoidsDB = nil
+	return err
+}
+
+// normalizeKey lowercases key and collapses its whitespace, so that "Foo  bar"
+// and "foo bar" are the same factoid.
+func normalizeKey(key string) string {
+	return strings.ToLower(strings.Join(strings.Fields(key), " "))
+}
+
+// namespace returns the channel factoids given in reply are stored under.
+// Factoids learned privately, or with -global, are global.
+func namespace(arg, reply string, isPrivate bool) (string, string) {
+	channel := strings.ToLower(reply)
+	if isPrivate {
+		channel = global
+	}
+	if strings.HasPrefix(arg, "-global ") {
+		channel, arg = global, arg[len("-global "):]
+	}
+	return channel, strings.TrimSpace(arg)
+}
+
+// mayChange returns whether the user src may change factoids in channel.
+// Anyone may change a channel's factoids, but only trusted users the global
+// ones.
+func mayChange(channel, src string) bool {
+	return channel != global || config.trusted.Match(src)
+}
+
+func describeNamespace(channel string) string {
+	if channel == global {
+		return "global"
+	}
+	return channel
+}
+
+// handleLookup answers ?key, from the channel's factoids or the global ones.
+// Unknown keys are ignored, as the prefix is often used for other things.
+func handleLookup(conn *irc.Conn, line irc.Line, dst, text string) {
+	if line.Src.Nick == "" || !strings.HasPrefix(text, config.Prefix) || strings.HasPrefix(text[len(config.Prefix):], " ") {
+		return
+	}
+	key := normalizeKey(text[len(config.Prefix):])
+	if key == "" || len(key) > config.MaxKeyLength || strings.HasPrefix(key, config.Prefix) {
+		return
+	}
+	f, err := find(factoidsDB, strings.ToLower(dst), key)
+	if err != nil {
+		fmt.Println("factoids:", err)
+		return
+	} else if f == nil {
+		return
+	}
+
+	value := strings.Replace(f.value, "$nick", line.Src.Nick, -1)
+	value = strings.Replace(value, "$channel", dst, -1)
+	if verb, rest := splitVerb(value); verb == "<reply>" {
+		plugin.Conn(conn).Notice(dst, rest)
+	} else if verb == "<action>" {
+		plugin.Conn(conn).Action(dst, rest)
+	} else {
+		plugin.Conn(conn).Notice(dst, fmt.Sprintf("%s is %s", f.key, value))
+	}
+}
+
+// splitVerb splits a leading <reply> or <action> from value.
+func splitVerb(value string) (string, string) {
+	for _, verb := range []string{"<reply>", "<action>"} {
+		if len(value) >= len(verb) && strings.EqualFold(value[:len(verb)], verb) {
+			return verb, strings.TrimSpace(value[len(verb):])
+		}
+	}
+	return "", value
+}
+
+func handleLearn(conn *irc.Conn, line irc.Line, arg, reply string, isPrivate bool) {
+	channel, arg := namespace(arg, reply, isPrivate)
+	if !mayChange(channel, line.Src.Raw) {
+		plugin.Conn(conn).Notice(reply, "factoids: you aren't allowed to change global factoids")
+		return
+	}
+	i := strings.Index(arg, "=")
+	if i < 0 {
+		plugin.Conn(conn).Notice(reply, fmt.Sprintf("usage: %slearn [-global] key = value", command.CommandPrefix))
+		return
+	}
+	key, value := normalizeKey(arg[:i]), strings.TrimSpace(arg[i+1:])
+	if key == "" || value == "" {
+		plugin.Conn(conn).Notice(reply, fmt.Sprintf("usage: %slearn [-global] key = value", command.CommandPrefix))
+		return
+	} else if len(key) > config.MaxKeyLength {
+		plugin.Conn(conn).Notice(reply, "factoids: key is too long")
+		return
+	} else if len(value) > config.MaxValueLength {
+		plugin.Conn(conn).Notice(reply, "factoids: value is too long")
+		return
+	} else if verb, rest := splitVerb(value); verb != "" && rest == "" {
+		plugin.Conn(conn).Notice(reply, "factoids: "+verb+" needs some text")
+		return
+	}
+
+	old, existed, err := learn(factoidsDB, channel, key, value, line.Src.Nick, time.Now())
+	if err != nil {
+		fmt.Println("error in !learn:", err)
+		plugin.Conn(conn).Notice(reply, "factoids: Internal error occurred")
+		return
+	}
+	if existed {
+		plugin.Conn(conn).Notice(reply, fmt.Sprintf("OK, %s (%s) was %s", key, describeNamespace(channel), old))
+	} else {
+		plugin.Conn(conn).Notice(reply, fmt.Sprintf("OK, learned %s (%s)", key, describeNamespace(channel)))
+	}
+}
+
+func handleForget(conn *irc.Conn, line irc.Line, arg, reply string, isPrivate bool) {
+	channel, arg := namespace(arg, reply, isPrivate)
+	if !mayChange(channel, line.Src.Raw) {
+		plugin.Conn(conn).Notice(reply, "factoids: you aren't allowed to change global factoids")
+		return
+	}
+	key := normalizeKey(arg)
+	if key == "" {
+		plugin.Conn(conn).Notice(reply, fmt.Sprintf("usage: %sforget [-global] key", command.CommandPrefix))
+		return
+	}
+	ok, err := forget(factoidsDB, channel, key, line.Src.Nick, time.Now())
+	if err != nil {
+		fmt.Println("error in !forget:", err)
+		plugin.Conn(conn).Notice(reply, "factoids: Internal error occurred")
+		return
+	}
+	if ok {
+		plugin.Conn(conn).Notice(reply, fmt.Sprintf("OK, forgot %s (%s)", key, describeNamespace(channel)))
+	} else if f, err := find(factoidsDB, global, key); err == nil && f != nil {
+		// don't let a channel forget a global factoid by accident
+		plugin.Conn(conn).Notice(reply, fmt.Sprintf("factoids: %s is global, use %sforget -global %s", key, command.CommandPrefix, key))
+	} else {
+		plugin.Conn(conn).Notice(reply, fmt.Sprintf("factoids: I don't know %s", key))
+	}
+}
+
+func handleInfo(conn *irc.Conn, line irc.Line, arg, reply string, isPrivate bool) {
+	channel, arg := namespace(arg, reply, isPrivate)
+	key := normalizeKey(arg)
+	if key == "" {
+		plugin.Conn(conn).Notice(reply, fmt.Sprintf("usage: %sfactinfo key", command.CommandPrefix))
+		return
+	}
+	f, err := find(factoidsDB, channel, key)
+	if err != nil {
+		fmt.Println("error in !factinfo:", err)
+		plugin.Conn(conn).Notice(reply, "factoids: Internal error occurred")
+		return
+	} else if f == nil {
+		plugin.Conn(conn).Notice(reply, fmt.Sprintf("factoids: I don't know %s", key))
+		return
+	}
+	revisions, count, err := history(factoidsDB, f.channel, f.key, 1)
+	if err != nil {
+		fmt.Println("error in !factinfo:", err)
+		plugin.Conn(conn).Notice(reply, "factoids: Internal error occurred")
+		return
+	}
+	msg := fmt.Sprintf("%s (%s) was learned by %s on %s", f.key, describeNamespace(f.channel), f.creator, f.created.Local().Format(timeFormat))
+	if len(revisions) > 0 && revisions[0].action == actionEdit {
+		last := revisions[0]
+		msg += fmt.Sprintf(", last changed by %s on %s (%d revisions, see %sfacthistory)", last.nick, last.timestamp.Local().Format(timeFormat), count, command.CommandPrefix)
+	}
+	plugin.Conn(conn).Notice(reply, msg)
+}
+
+// handleHistory sends the recent revisions of a factoid privately, including
+// forgotten ones, so that mistakes can be undone.
+func handleHistory(conn *irc.Conn, line irc.Line, arg, reply string, isPrivate bool) {
+	channel, arg := namespace(arg, reply, isPrivate)
+	key := normalizeKey(arg)
+	if key == "" {
+		plugin.Conn(conn).Notice(reply, fmt.Sprintf("usage: %sfacthistory [-global] key", command.CommandPrefix))
+		return
+	}
+	revisions, count, err := history(factoidsDB, channel, key, maxRevisions)
+	if err == nil && count == 0 && channel != global {
+		channel = global
+		revisions, count, err = history(factoidsDB, channel, key, maxRevisions)
+	}
+	if err != nil {
+		fmt.Println("error in !facthistory:", err)
+		plugin.Conn(conn).Notice(reply, "factoids: Internal error occurred")
+		return
+	} else if count == 0 {
+		plugin.Conn(conn).Notice(reply, fmt.Sprintf("factoids: I don't know %s", key))
+		return
+	}
+
+	nick := line.Src.Nick
+	for _, r := range revisions {
+		timestr := r.timestamp.Local().Format(timeFormat)
+		switch r.action {
+		case actionForget:
+			plugin.Conn(conn).Notice(nick, fmt.Sprintf("%s: %s forgot %s (%s), which was %s", timestr, r.nick, r.key, describeNamespace(r.channel), r.value))
+		default:
+			plugin.Conn(conn).Notice(nick, fmt.Sprintf("%s: %s set %s (%s) to %s", timestr, r.nick, r.key, describeNamespace(r.channel), r.value))
+		}
+	}
+	if count > len(revisions) {
+		plugin.Conn(conn).Notice(nick, fmt.Sprintf("(%d older revisions)", count-len(revisions)))
+	}
+}
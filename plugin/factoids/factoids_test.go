@@ -0,0 +1,197 @@
+package factoids
+
+import (
+	"../../utils"
+	"../database"
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func openTestDB(t *testing.T) (*sql.DB, func()) {
+	dir, err := ioutil.TempDir("", "factoids")
+	if err != nil {
+		t.Fatal(err)
+	}
+	database.SetDataDir(dir)
+	db, err := database.OpenNamed("factoids.db")
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return db, func() {
+		database.Close(db)
+		os.RemoveAll(dir)
+	}
+}
+
+func TestNamespace(t *testing.T) {
+	tests := []struct {
+		arg, reply string
+		isPrivate  bool
+		channel    string
+		rest       string
+	}{
+		{"foo = bar", "#Chan", false, "#chan", "foo = bar"},
+		{"-global foo = bar", "#chan", false, global, "foo = bar"},
+		{"foo = bar", "alice", true, global, "foo = bar"},
+		{"-global  foo", "alice", true, global, "foo"},
+		{"-globalfoo", "#chan", false, "#chan", "-globalfoo"},
+	}
+	for _, test := range tests {
+		channel, rest := namespace(test.arg, test.reply, test.isPrivate)
+		if channel != test.channel || rest != test.rest {
+			t.Errorf("namespace(%q, %q, %v) = %q, %q, want %q, %q", test.arg, test.reply, test.isPrivate, channel, rest, test.channel, test.rest)
+		}
+	}
+}
+
+func TestNormalizeKey(t *testing.T) {
+	tests := []struct {
+		key, want string
+	}{
+		{"Foo", "foo"},
+		{"  foo   Bar ", "foo bar"},
+		{"foo\tbar", "foo bar"},
+		{"", ""},
+	}
+	for _, test := range tests {
+		if got := normalizeKey(test.key); got != test.want {
+			t.Errorf("normalizeKey(%q) = %q, want %q", test.key, got, test.want)
+		}
+	}
+}
+
+func TestSplitVerb(t *testing.T) {
+	tests := []struct {
+		value, verb, rest string
+	}{
+		{"a thing", "", "a thing"},
+		{"<reply> hello", "<reply>", "hello"},
+		{"<REPLY>hello ", "<reply>", "hello"},
+		{"<action> waves", "<action>", "waves"},
+		{"<action>", "<action>", ""},
+		{"<reply", "", "<reply"},
+		{"say <reply> hi", "", "say <reply> hi"},
+	}
+	for _, test := range tests {
+		if verb, rest := splitVerb(test.value); verb != test.verb || rest != test.rest {
+			t.Errorf("splitVerb(%q) = %q, %q, want %q, %q", test.value, verb, rest, test.verb, test.rest)
+		}
+	}
+}
+
+func TestMayChange(t *testing.T) {
+	defer func(c factoidsConfig) { config = c }(config)
+	var err error
+	if config.trusted, err = utils.CompileHostmasks([]string{"*!*@example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		channel, src string
+		ok           bool
+	}{
+		{"#chan", "bob!b@evil.com", true},
+		{global, "bob!b@evil.com", false},
+		{global, "bob!b@example.com", true},
+		{global, "", false},
+	}
+	for _, test := range tests {
+		if got := mayChange(test.channel, test.src); got != test.ok {
+			t.Errorf("mayChange(%q, %q) = %v, want %v", test.channel, test.src, got, test.ok)
+		}
+	}
+}
+
+func TestFind(t *testing.T) {
+	db, cleanup := openTestDB(t)
+	defer cleanup()
+	now := time.Now()
+	for _, f := range []struct{ channel, key, value string }{
+		{global, "foo", "global foo"},
+		{"#a", "foo", "#a foo"},
+		{"#a", "bar", "#a bar"},
+	} {
+		if _, _, err := learn(db, f.channel, f.key, f.value, "alice", now); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		channel, key string
+		value        string // or "" if not found
+		from         string
+	}{
+		{"#a", "foo", "#a foo", "#a"},
+		{"#b", "foo", "global foo", global},
+		{global, "foo", "global foo", global},
+		{"#a", "bar", "#a bar", "#a"},
+		{"#b", "bar", "", ""},
+		{"#a", "baz", "", ""},
+	}
+	for _, test := range tests {
+		f, err := find(db, test.channel, test.key)
+		if err != nil {
+			t.Errorf("find(%q, %q): %v", test.channel, test.key, err)
+		} else if test.value == "" && f != nil {
+			t.Errorf("find(%q, %q) = %q, want none", test.channel, test.key, f.value)
+		} else if test.value != "" && (f == nil || f.value != test.value || f.channel != test.from) {
+			t.Errorf("find(%q, %q) = %+v, want %q from %q", test.channel, test.key, f, test.value, test.from)
+		}
+	}
+}
+
+func TestHistory(t *testing.T) {
+	db, cleanup := openTestDB(t)
+	defer cleanup()
+	now := time.Now()
+
+	if old, existed, err := learn(db, "#a", "foo", "one", "alice", now); err != nil || existed || old != "" {
+		t.Fatalf("first learn = %q, %v, %v", old, existed, err)
+	}
+	if old, existed, err := learn(db, "#a", "foo", "two", "bob", now.Add(time.Minute)); err != nil || !existed || old != "one" {
+		t.Fatalf("second learn = %q, %v, %v", old, existed, err)
+	}
+	if ok, err := forget(db, "#a", "foo", "carol", now.Add(2*time.Minute)); err != nil || !ok {
+		t.Fatalf("forget = %v, %v", ok, err)
+	}
+	if ok, err := forget(db, "#a", "foo", "carol", now.Add(3*time.Minute)); err != nil || ok {
+		t.Fatalf("second forget = %v, %v", ok, err)
+	}
+	if f, err := find(db, "#a", "foo"); err != nil || f != nil {
+		t.Fatalf("find after forget = %+v, %v", f, err)
+	}
+
+	revisions, count, err := history(db, "#a", "foo", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 3 {
+		t.Errorf("count = %d, want 3", count)
+	}
+	want := []struct{ action, value, nick string }{
+		{actionForget, "two", "carol"},
+		{actionEdit, "two", "bob"},
+	}
+	if len(revisions) != len(want) {
+		t.Fatalf("got %d revisions, want %d", len(revisions), len(want))
+	}
+	for i, r := range revisions {
+		if r.action != want[i].action || r.value != want[i].value || r.nick != want[i].nick {
+			t.Errorf("revision %d = %s %q by %s, want %s %q by %s", i, r.action, r.value, r.nick, want[i].action, want[i].value, want[i].nick)
+		}
+	}
+
+	// relearning a forgotten factoid starts it afresh, but keeps its history
+	if _, existed, err := learn(db, "#a", "foo", "three", "dave", now.Add(4*time.Minute)); err != nil || existed {
+		t.Fatalf("relearn = %v, %v", existed, err)
+	}
+	if f, err := find(db, "#a", "foo"); err != nil || f == nil || f.creator != "dave" {
+		t.Errorf("relearned factoid = %+v, %v, want creator dave", f, err)
+	}
+	if _, count, err := history(db, "#a", "foo", 1); err != nil || count != 4 {
+		t.Errorf("history count after relearning = %d, %v, want 4", count, err)
+	}
+}
@@ -2,6 +2,8 @@ package flickr
 
 import (
 	"../"
+	"../cache"
+	"../urlevent"
 	"encoding/xml"
 	"errors"
 	"fmt"
@@ -11,27 +13,29 @@ import (
 	"net/url"
 	"os"
 	"strings"
+	"time"
 	"unicode"
 )
 
 var flickrLogo = "\00312flick\00313r\017"
 
-func init() {
-	plugin.RegisterPlugin("flickr", plugin.Callbacks{Init: setupFlickr})
+var config struct {
+	APIKey string `yaml:"api_key"`
 }
 
-var api_key = ""
+func init() {
+	plugin.RegisterPlugin("flickr", plugin.Callbacks{Init: setupFlickr, Config: &config, Requires: []string{"URL"}})
+}
 
-func setupFlickr(reg *callback.Registry, config map[string]interface{}) error {
-	if key, ok := config["api_key"].(string); ok {
-		api_key = key
-	} else {
+func setupFlickr(reg *callback.Registry, _ map[string]interface{}) error {
+	if config.APIKey == "" {
 		// can't do much without an API key
+		fmt.Fprintln(os.Stderr, "flickr: no api_key configured, plugin disabled")
 		return nil
 	}
-	reg.AddCallback("URL", func(conn *irc.Conn, line irc.Line, dst string, url *url.URL) {
+	urlevent.AddClaimer(func(conn *irc.Conn, line irc.Line, dst string, url *url.URL, claim *urlevent.Claim) {
 		if url.Host == "flickr.com" || url.Host == "www.flickr.com" {
-			if photo_id, set_id, ok := parseFlickrURL(url); ok {
+			if photo_id, set_id, ok := parseFlickrURL(url); ok && claim.Take("flickr") {
 				if photo_id != "" {
 					go processFlickrPhoto(plugin.Conn(conn), line, dst, photo_id)
 				} else {
@@ -82,34 +86,48 @@ type RespErr struct {
 	Msg  string `xml:"msg,attr"`
 }
 
+func (e *RespErr) Error() string {
+	if e == nil {
+		return "error (unknown)"
+	}
+	return fmt.Sprintf("error %d: %s", e.Code, e.Msg)
+}
+
+var flickrCache = cache.New("flickr", 6*time.Hour)
+
 func processFlickrPhoto(conn plugin.IrcConn, line irc.Line, dst, photo_id string) {
-	resp, err := callAPI("flickr.photos.getInfo", "photo_id", photo_id)
+	var msg string
+	err := flickrCache.Get("photo/"+photo_id, &msg, func() (interface{}, error) {
+		return fetchPhoto(photo_id)
+	})
 	if err != nil {
-		fmt.Fprintln(os.Stderr, err)
+		fmt.Fprintln(os.Stderr, "flickr:", err)
 		return
 	}
+	conn.Notice(dst, flickrLogo+" | "+msg)
+}
+
+func fetchPhoto(photo_id string) (string, error) {
+	resp, err := callAPI("flickr.photos.getInfo", "photo_id", photo_id)
+	if err != nil {
+		return "", err
+	}
 	defer resp.Body.Close()
 
 	var rsp PhotoResp
 	if err := xml.NewDecoder(resp.Body).Decode(&rsp); err != nil {
-		fmt.Fprintln(os.Stderr, "flickr:", err)
-		return
+		return "", err
 	}
 
 	if rsp.Stat != "ok" {
-		if rsp.Err == nil {
-			fmt.Fprintln(os.Stderr, "flickr error (unknown)")
-			return
-		}
-		fmt.Fprintf(os.Stderr, "flickr error %d: %s\n", rsp.Err.Code, rsp.Err.Msg)
-		return
+		return "", rsp.Err
 	}
 
 	msg := fmt.Sprintf("%s (%s) - %s", rsp.Photo.Owner.Realname, rsp.Photo.Owner.Username, rsp.Photo.Title)
 	if rsp.Photo.Media != "photo" {
 		msg += fmt.Sprintf(" [%s]", rsp.Photo.Media)
 	}
-	conn.Notice(dst, flickrLogo+" | "+msg)
+	return msg, nil
 }
 
 type PhotosetResp struct {
@@ -131,26 +149,31 @@ type PhotosetResp struct {
 }
 
 func processFlickrSet(conn plugin.IrcConn, line irc.Line, dst, set_id string) {
-	resp, err := callAPI("flickr.photosets.getInfo", "photoset_id", set_id)
+	var msg string
+	err := flickrCache.Get("set/"+set_id, &msg, func() (interface{}, error) {
+		return fetchSet(set_id)
+	})
 	if err != nil {
-		fmt.Fprintln(os.Stderr, err)
+		fmt.Fprintln(os.Stderr, "flickr:", err)
 		return
 	}
+	conn.Notice(dst, flickrLogo+" | "+msg)
+}
+
+func fetchSet(set_id string) (string, error) {
+	resp, err := callAPI("flickr.photosets.getInfo", "photoset_id", set_id)
+	if err != nil {
+		return "", err
+	}
 	defer resp.Body.Close()
 
 	var rsp PhotosetResp
 	if err := xml.NewDecoder(resp.Body).Decode(&rsp); err != nil {
-		fmt.Fprintln(os.Stderr, "flickr:", err)
-		return
+		return "", err
 	}
 
 	if rsp.Stat != "ok" {
-		if rsp.Err == nil {
-			fmt.Fprintln(os.Stderr, "flickr error (unknown)")
-			return
-		}
-		fmt.Fprintf(os.Stderr, "flickr error %d: %s", rsp.Err.Code, rsp.Err.Msg)
-		return
+		return "", rsp.Err
 	}
 
 	msg := fmt.Sprintf("%s - %s", rsp.Photoset.Username, rsp.Photoset.Title)
@@ -159,19 +182,19 @@ func processFlickrSet(conn plugin.IrcConn, line irc.Line, dst, set_id string) {
 	} else {
 		msg += fmt.Sprintf(" (%d photos)", rsp.Photoset.Photos)
 	}
-	conn.Notice(dst, flickrLogo+" | "+msg)
+	return msg, nil
 }
 
 func callAPI(method, key, val string) (*http.Response, error) {
-	url := fmt.Sprintf("https://api.flickr.com/services/rest/?method=%s&api_key=%s&%s=%s", method, api_key, key, val)
-	resp, err := http.Get(url)
+	url := fmt.Sprintf("https://api.flickr.com/services/rest/?method=%s&api_key=%s&%s=%s", method, config.APIKey, key, val)
+	resp, err := plugin.HTTPGet(url)
 	if err != nil {
 		return nil, err
 	}
 
 	if resp.StatusCode != 200 {
 		resp.Body.Close()
-		return nil, errors.New(fmt.Sprintf("flickr: unexpected response: %s", resp))
+		return nil, errors.New(fmt.Sprintf("unexpected response: %s", resp.Status))
 	}
 
 	return resp, nil
@@ -0,0 +1,307 @@
+package plugin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// HTTPConfig configures the HTTP client shared by all plugins. It is read
+// from the http section of the config file.
+type HTTPConfig struct {
+	Timeout      time.Duration `yaml:"timeout"`
+	Proxy        string        `yaml:"proxy"`
+	UserAgent    string        `yaml:"user_agent"`
+	MaxBodyBytes int64         `yaml:"max_body_bytes"`
+	Retries      int           `yaml:"retries"`
+	RetryBackoff time.Duration `yaml:"retry_backoff"`
+	MaxPerHost   int           `yaml:"max_per_host"`
+	// Allow requests to loopback, private and link-local addresses. They're
+	// refused by default, so that users can't make the bot probe the network
+	// it runs on by posting links.
+	AllowPrivateAddresses bool `yaml:"allow_private_addresses"`
+}
+
+func (c *HTTPConfig) Validate() error {
+	if c.Timeout <= 0 {
+		return errors.New("timeout must be positive")
+	} else if c.MaxBodyBytes <= 0 {
+		return errors.New("max_body_bytes must be positive")
+	} else if c.Retries < 0 {
+		return errors.New("retries must not be negative")
+	} else if c.MaxPerHost <= 0 {
+		return errors.New("max_per_host must be positive")
+	}
+	if c.Proxy != "" {
+		if u, err := url.Parse(c.Proxy); err != nil || u.Host == "" {
+			return fmt.Errorf("invalid proxy URL %q", c.Proxy)
+		}
+	}
+	return nil
+}
+
+// ErrBodyTooLarge is returned when reading a response body that exceeds the
+// configured max_body_bytes.
+var ErrBodyTooLarge = errors.New("http: response body too large")
+
+// ErrPrivateAddress is returned when a request, or a redirect it follows,
+// would connect to a loopback, private or link-local address.
+var ErrPrivateAddress = errors.New("http: refusing to connect to a private address")
+
+// maximum delay honored from a Retry-After header
+const maxRetryAfter = 30 * time.Second
+
+var httpState struct {
+	sync.Mutex
+	config HTTPConfig
+	client *http.Client
+	hosts  map[string]chan struct{}
+	// the addresses of proxies, which may be private
+	proxies map[string]bool
+}
+
+func init() {
+	ConfigureHTTP(nil)
+}
+
+// ConfigureHTTP sets up the shared HTTP client from the http section of the
+// config file. Unspecified values use the defaults.
+func ConfigureHTTP(raw map[string]interface{}) error {
+	config := HTTPConfig{
+		Timeout:      30 * time.Second,
+		UserAgent:    "voidbot (+https://github.com/lilyball/voidbot)",
+		MaxBodyBytes: 2 << 20,
+		Retries:      2,
+		RetryBackoff: time.Second,
+		MaxPerHost:   4,
+	}
+	if err := DecodeConfig("http", raw, &config); err != nil {
+		return err
+	}
+	proxy := http.ProxyFromEnvironment
+	if config.Proxy != "" {
+		u, _ := url.Parse(config.Proxy) // validated already
+		proxy = http.ProxyURL(u)
+	}
+	transport := &http.Transport{
+		Proxy:                 recordProxy(proxy),
+		DialContext:           dialContext(config.AllowPrivateAddresses),
+		ResponseHeaderTimeout: config.Timeout,
+	}
+	client := &http.Client{
+		Timeout:       config.Timeout,
+		Transport:     transport,
+		CheckRedirect: checkRedirect,
+	}
+
+	httpState.Lock()
+	defer httpState.Unlock()
+	httpState.config = config
+	httpState.client = client
+	httpState.hosts = make(map[string]chan struct{})
+	httpState.proxies = make(map[string]bool)
+	return nil
+}
+
+// recordProxy wraps proxy to note the address of each proxy used, so that
+// connections to it are allowed even if it's on a private address. The proxy
+// resolves the hosts it connects to itself, so it must do its own filtering.
+func recordProxy(proxy func(*http.Request) (*url.URL, error)) func(*http.Request) (*url.URL, error) {
+	return func(req *http.Request) (*url.URL, error) {
+		u, err := proxy(req)
+		if u != nil {
+			port := u.Port()
+			if port == "" {
+				port = map[string]string{"https": "443", "socks5": "1080"}[u.Scheme]
+			}
+			if port == "" {
+				port = "80"
+			}
+			httpState.Lock()
+			httpState.proxies[net.JoinHostPort(u.Hostname(), port)] = true
+			httpState.Unlock()
+		}
+		return u, err
+	}
+}
+
+// dialContext returns a dial function that refuses connections to private
+// addresses unless allowPrivate is set. The address is checked after the
+// host name is resolved, so names that resolve to private addresses are
+// refused too.
+func dialContext(allowPrivate bool) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+	guarded := &net.Dialer{Timeout: dialer.Timeout, KeepAlive: dialer.KeepAlive, Control: checkAddress}
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		httpState.Lock()
+		isProxy := httpState.proxies[addr]
+		httpState.Unlock()
+		if allowPrivate || isProxy {
+			return dialer.DialContext(ctx, network, addr)
+		}
+		return guarded.DialContext(ctx, network, addr)
+	}
+}
+
+func checkAddress(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip == nil || isPrivateIP(ip) {
+		return ErrPrivateAddress
+	}
+	return nil
+}
+
+var privateNets []*net.IPNet
+
+func init() {
+	for _, cidr := range []string{
+		"0.0.0.0/8",      // this network
+		"10.0.0.0/8",     // private
+		"100.64.0.0/10",  // carrier-grade NAT
+		"127.0.0.0/8",    // loopback
+		"169.254.0.0/16", // link-local
+		"172.16.0.0/12",  // private
+		"192.168.0.0/16", // private
+		"::/128",         // unspecified
+		"::1/128",        // loopback
+		"fc00::/7",       // unique local
+		"fe80::/10",      // link-local
+	} {
+		_, ipnet, _ := net.ParseCIDR(cidr)
+		privateNets = append(privateNets, ipnet)
+	}
+}
+
+// isPrivateIP returns whether ip is a loopback, private or link-local
+// address, or one that otherwise isn't reachable on the internet.
+func isPrivateIP(ip net.IP) bool {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	for _, ipnet := range privateNets {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return ip.IsMulticast()
+}
+
+// HTTPGet issues a GET request using the shared client. See HTTPDo.
+func HTTPGet(url string) (*http.Response, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	return HTTPDo(req)
+}
+
+// the context key marking requests that shouldn't follow redirects
+type noRedirectKey struct{}
+
+func checkRedirect(req *http.Request, via []*http.Request) error {
+	if via[0].Context().Value(noRedirectKey{}) != nil {
+		return http.ErrUseLastResponse
+	} else if len(via) >= 10 {
+		return errors.New("stopped after 10 redirects")
+	}
+	return nil
+}
+
+// HTTPDoNoRedirect is like HTTPDo, except that redirect responses are
+// returned rather than followed.
+func HTTPDoNoRedirect(req *http.Request) (*http.Response, error) {
+	return HTTPDo(req.WithContext(context.WithValue(req.Context(), noRedirectKey{}, true)))
+}
+
+// HTTPDo sends the request using the shared client. GET and HEAD requests are
+// retried with exponential backoff when the server responds with a 5xx or 429
+// status. Reading the returned body fails with ErrBodyTooLarge once it exceeds
+// the configured limit. Every successful call must be balanced by closing
+// the response body, as that releases the per-host connection slot.
+func HTTPDo(req *http.Request) (*http.Response, error) {
+	httpState.Lock()
+	config, client := httpState.config, httpState.client
+	sem := httpState.hosts[req.URL.Host]
+	if sem == nil {
+		sem = make(chan struct{}, config.MaxPerHost)
+		httpState.hosts[req.URL.Host] = sem
+	}
+	httpState.Unlock()
+
+	if req.Header.Get("User-Agent") == "" {
+		req.Header.Set("User-Agent", config.UserAgent)
+	}
+
+	select {
+	case sem <- struct{}{}:
+	case <-time.After(config.Timeout):
+		return nil, fmt.Errorf("http: timed out waiting for a connection to %s", req.URL.Host)
+	}
+	release := func() { <-sem }
+
+	retryable := req.Method == "GET" || req.Method == "HEAD"
+	backoff := config.RetryBackoff
+	for attempt := 0; ; attempt++ {
+		resp, err := client.Do(req)
+		if err != nil {
+			release()
+			return nil, err
+		}
+		if retryable && attempt < config.Retries && (resp.StatusCode >= 500 || resp.StatusCode == 429) {
+			delay := backoff
+			if secs, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && secs >= 0 {
+				delay = time.Duration(secs) * time.Second
+				if delay > maxRetryAfter {
+					delay = maxRetryAfter
+				}
+			}
+			resp.Body.Close()
+			time.Sleep(delay)
+			backoff *= 2
+			continue
+		}
+		resp.Body = &limitedBody{ReadCloser: resp.Body, remaining: config.MaxBodyBytes, release: release}
+		return resp, nil
+	}
+}
+
+type limitedBody struct {
+	io.ReadCloser
+	remaining int64
+	release   func()
+	once      sync.Once
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if b.remaining <= 0 {
+		// see if there's anything left before complaining
+		var buf [1]byte
+		if n, _ := b.ReadCloser.Read(buf[:]); n > 0 {
+			return 0, ErrBodyTooLarge
+		}
+		return 0, io.EOF
+	}
+	if int64(len(p)) > b.remaining {
+		p = p[:b.remaining]
+	}
+	n, err := b.ReadCloser.Read(p)
+	b.remaining -= int64(n)
+	return n, err
+}
+
+func (b *limitedBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.release)
+	return err
+}
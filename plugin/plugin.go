@@ -14,6 +14,9 @@ type Plugin struct {
 	Name      string
 	Callbacks Callbacks
 	inited    bool
+	// the config after decoding, so that it's only decoded once
+	config  map[string]interface{}
+	decoded bool
 }
 
 type Callbacks struct {
@@ -21,6 +24,16 @@ type Callbacks struct {
 	Teardown      func() error
 	NewConnection func(irc.HandlerRegistry)
 	Disconnected  func()
+	// Config is an optional pointer to a struct that the plugin's config is
+	// decoded into before Init is called. See config.go.
+	Config interface{}
+	// Depends lists plugins that must be loaded and initialized first.
+	Depends []string
+	// Requires lists the events this plugin listens for that are dispatched
+	// by other plugins, and Provides lists the events this plugin dispatches.
+	// Missing providers are enabled automatically. See deps.go.
+	Requires []string
+	Provides []string
 }
 
 const (
@@ -32,6 +45,7 @@ const (
 var pluginState struct {
 	sync.Mutex
 	Plugins []*Plugin
+	Order   []*Plugin // initialized plugins, in init order
 	State   int
 }
 
@@ -55,12 +69,32 @@ func PluginNames() []string {
 }
 
 // Some utility functions for connections
+//
+// Every message, notice and action sent through an IrcConn is dispatched as
+// an OUTGOING event, so plugins can observe the bot's own lines:
+//
+//	func(conn *irc.Conn, dst, text, kind string)
+//
+// where kind is "PRIVMSG", "NOTICE" or "ACTION". Plugins should send
+// everything through an IrcConn rather than the *irc.Conn, so that none of
+// their output is missed. Lines typed on standard input aren't dispatched.
 type IrcConn struct {
 	conn irc.SafeConn
+	raw  *irc.Conn
 }
 
 func Conn(conn *irc.Conn) IrcConn {
-	return IrcConn{conn.SafeConn()}
+	return IrcConn{conn.SafeConn(), conn}
+}
+
+func init() {
+	RegisterPlugin("", Callbacks{Provides: []string{"OUTGOING"}})
+}
+
+func (c IrcConn) dispatchOutgoing(dst, line, kind string) {
+	if registry != nil {
+		registry.Dispatch("OUTGOING", c.raw, dst, line, kind)
+	}
 }
 
 func msgToLines(msg string) []string {
@@ -94,6 +128,7 @@ func (c IrcConn) PrivmsgN(dst, msg string, n int) {
 	for _, line := range lines {
 		logLine("%s: %s", dst, utils.ColorToANSI(line))
 		c.conn.Privmsg(dst, line)
+		c.dispatchOutgoing(dst, line, "PRIVMSG")
 	}
 }
 
@@ -106,6 +141,7 @@ func (c IrcConn) NoticeN(dst, msg string, n int) {
 	for _, line := range lines {
 		logLine("NOTICE[%s]: %s", dst, utils.ColorToANSI(line))
 		c.conn.Notice(dst, line)
+		c.dispatchOutgoing(dst, line, "NOTICE")
 	}
 }
 
@@ -118,6 +154,7 @@ func (c IrcConn) ActionN(dst, msg string, n int) {
 	for _, line := range lines {
 		logLine("ACTION[%s]: %s %s\n", dst, c.conn.Me(), utils.ColorToANSI(line))
 		c.conn.Action(dst, line)
+		c.dispatchOutgoing(dst, line, "ACTION")
 	}
 }
 
@@ -137,34 +174,33 @@ var registry *callback.Registry
 
 // InvokeInit stops at the first error
 // If plugins is nil, all plugins are inited.
-// Otherwise, only the listed plugins are inited.
+// Otherwise, only the listed plugins (and their dependencies) are inited.
+// Plugins are inited after the plugins they depend on.
 func InvokeInit(plugins []string, config map[string]map[string]interface{}) error {
 	pluginState.Lock()
 	defer pluginState.Unlock()
 	if pluginState.State != StatePreInit {
 		panic("InvokeInit called after init")
 	}
-	var pluginMap map[string]bool
-	if plugins != nil {
-		pluginMap = make(map[string]bool, len(plugins))
-		pluginMap[""] = true // always load unnamed plugins, they're for support
-		for _, name := range plugins {
-			pluginMap[name] = true
-		}
-	}
 	pluginState.State = StatePostInit
+	order, _, err := resolvePlugins(plugins)
+	if err != nil {
+		return err
+	}
 	registry = callback.NewRegistry(callback.DispatchSerial)
-	for _, plugin := range pluginState.Plugins {
-		if pluginMap != nil && !pluginMap[plugin.Name] {
-			continue
-		}
+	for _, plugin := range order {
 		callbacks := plugin.Callbacks
+		pconfig, err := pluginConfig(plugin, config[plugin.Name])
+		if err != nil {
+			return err
+		}
 		if callbacks.Init != nil {
-			if err := callbacks.Init(registry, config[plugin.Name]); err != nil {
+			if err := callbacks.Init(registry, pconfig); err != nil {
 				return err
 			}
 		}
 		plugin.inited = true
+		pluginState.Order = append(pluginState.Order, plugin)
 	}
 	return nil
 }
@@ -175,11 +211,8 @@ func InvokeNewConnection(reg irc.HandlerRegistry) {
 	if pluginState.State != StatePostInit {
 		panic("InvokeNewConnection called in wrong state")
 	}
-	for _, plugin := range pluginState.Plugins {
+	for _, plugin := range pluginState.Order {
 		callbacks := plugin.Callbacks
-		if !plugin.inited {
-			continue
-		}
 		if callbacks.NewConnection != nil {
 			callbacks.NewConnection(reg)
 		}
@@ -192,11 +225,8 @@ func InvokeDisconnected() {
 	if pluginState.State != StatePostInit {
 		panic("InvokeDisconnected called in wrong state")
 	}
-	for _, plugin := range pluginState.Plugins {
+	for _, plugin := range pluginState.Order {
 		callbacks := plugin.Callbacks
-		if !plugin.inited {
-			continue
-		}
 		if callbacks.Disconnected != nil {
 			callbacks.Disconnected()
 		}
@@ -211,7 +241,9 @@ func InvokeTeardown() {
 	}
 	pluginState.State = StatePostTeardown
 
-	for _, plugin := range pluginState.Plugins {
+	// tear down in the reverse of init order
+	for i := len(pluginState.Order) - 1; i >= 0; i-- {
+		plugin := pluginState.Order[i]
 		callbacks := plugin.Callbacks
 		if plugin.inited && callbacks.Teardown != nil {
 			if err := callbacks.Teardown(); err != nil {
@@ -220,6 +252,7 @@ func InvokeTeardown() {
 		}
 		plugin.inited = false
 	}
+	pluginState.Order = nil
 }
 
 // Other miscellaneous utility functions for plugins
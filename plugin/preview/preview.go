@@ -0,0 +1,321 @@
+package preview
+
+import (
+	"../"
+	"../../utils"
+	"../cache"
+	"../urlevent"
+	"code.google.com/p/go.net/html"
+	"code.google.com/p/go.net/html/atom"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/kballard/gocallback/callback"
+	"github.com/kballard/goirc/irc"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A Provider describes how to preview links to a site. Matching URLs are
+// looked up using the site's oEmbed endpoint if it has one, or otherwise by
+// scraping the page's OpenGraph meta tags. The resulting fields are
+// substituted into Format, e.g. "{title} | {author_name}", and posted after
+// Prefix, along with {url}, {key} and {fragment} (#t=30, or empty). A field
+// may be written as {name|time} to format a number of seconds, or an ISO 8601
+// duration such as PT4M13S, as a duration.
+//
+// Built-in providers are registered as plugins of the same name with
+// RegisterProvider. Additional providers can be listed in the providers
+// section of the preview plugin's config.
+type Provider struct {
+	Name string `yaml:"name" config:"required"`
+	// Host patterns, e.g. "example.com" or "*.example.com"
+	Hosts []string `yaml:"hosts" config:"required"`
+	// Optional regular expression that the URL path must match
+	Path string `yaml:"path"`
+	// The oEmbed endpoint. The URL is passed in the url query parameter,
+	// or substituted for {url} if the endpoint contains it.
+	OEmbed string `yaml:"oembed"`
+	// Optional regular expression that the whole URL must match. Its first
+	// submatch is the {key} field, e.g. a video ID.
+	Key string `yaml:"key"`
+	// Fields to read from other meta tags when scraping, given as
+	// attribute=value, e.g. duration: itemprop=duration
+	Meta map[string]string `yaml:"meta"`
+	// How much of the page to read when scraping
+	MaxBytes int64  `yaml:"max_bytes"`
+	Prefix   string `yaml:"prefix"`
+	Format   string `yaml:"format"`
+	MaxLines int    `yaml:"max_lines"`
+
+	pathRegex *regexp.Regexp
+	keyRegex  *regexp.Regexp
+}
+
+var config struct {
+	Providers []*Provider `yaml:"providers"`
+}
+
+func init() {
+	plugin.RegisterPlugin("preview", plugin.Callbacks{Init: setup, Config: &config, Requires: []string{"URL"}})
+}
+
+// RegisterProvider registers a built-in provider as a plugin of the same
+// name. It must be called from init().
+func RegisterProvider(p Provider) {
+	plugin.RegisterPlugin(p.Name, plugin.Callbacks{
+		Init: func(reg *callback.Registry, _ map[string]interface{}) error {
+			return p.init(reg)
+		},
+		Requires: []string{"URL"},
+	})
+}
+
+func setup(reg *callback.Registry, _ map[string]interface{}) error {
+	for _, p := range config.Providers {
+		if err := p.init(reg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *Provider) init(reg *callback.Registry) error {
+	if err := p.compile(); err != nil {
+		return err
+	}
+	urlevent.AddClaimer(func(conn *irc.Conn, line irc.Line, dst string, url *url.URL, claim *urlevent.Claim) {
+		if p.Matches(url) && claim.Take(p.Name) {
+			go p.process(plugin.Conn(conn), dst, url)
+		}
+	})
+	return nil
+}
+
+// compile checks the provider's patterns and fills in defaults.
+func (p *Provider) compile() error {
+	if p.Path != "" {
+		re, err := regexp.Compile(p.Path)
+		if err != nil {
+			return fmt.Errorf("preview provider %q: invalid path regexp: %v", p.Name, err)
+		}
+		p.pathRegex = re
+	}
+	if p.Key != "" {
+		re, err := regexp.Compile(p.Key)
+		if err != nil {
+			return fmt.Errorf("preview provider %q: invalid key regexp: %v", p.Name, err)
+		} else if re.NumSubexp() < 1 {
+			return fmt.Errorf("preview provider %q: key regexp has no submatch", p.Name)
+		}
+		p.keyRegex = re
+	}
+	for field, meta := range p.Meta {
+		if !strings.Contains(meta, "=") {
+			return fmt.Errorf("preview provider %q: meta field %q must be of the form attribute=value", p.Name, field)
+		}
+	}
+	for _, pattern := range p.Hosts {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("preview provider %q: invalid host pattern %q", p.Name, pattern)
+		}
+	}
+	if p.Format == "" {
+		p.Format = "{title}"
+	}
+	if p.MaxLines == 0 {
+		p.MaxLines = 1
+	}
+	if p.MaxBytes == 0 {
+		p.MaxBytes = maxPageBytes
+	}
+	return nil
+}
+
+// Matches returns whether the provider handles the given URL.
+func (p *Provider) Matches(url *url.URL) bool {
+	if url.Scheme != "http" && url.Scheme != "https" {
+		return false
+	}
+	host := strings.ToLower(url.Hostname())
+	matched := false
+	for _, pattern := range p.Hosts {
+		if ok, _ := path.Match(strings.ToLower(pattern), host); ok {
+			matched = true
+			break
+		}
+	}
+	return matched && (p.pathRegex == nil || p.pathRegex.MatchString(url.Path)) &&
+		(p.keyRegex == nil || p.keyRegex.MatchString(url.String()))
+}
+
+var previewCache = cache.New("preview", 6*time.Hour)
+
+func (p *Provider) process(conn plugin.IrcConn, dst string, url *url.URL) {
+	var fields map[string]string
+	err := previewCache.Get(p.Name+" "+url.String(), &fields, func() (interface{}, error) {
+		if p.OEmbed != "" {
+			return fetchOEmbed(p.OEmbed, url)
+		}
+		return fetchOpenGraph(url, p.Meta, p.MaxBytes)
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "preview: %s: %v\n", p.Name, err)
+		return
+	}
+	fields["url"] = url.String()
+	fields["key"], fields["fragment"] = "", ""
+	if p.keyRegex != nil {
+		fields["key"] = p.keyRegex.FindStringSubmatch(url.String())[1]
+	}
+	if url.Fragment != "" {
+		fields["fragment"] = "#" + url.Fragment
+	}
+	text, ok := p.format(fields)
+	if !ok {
+		fmt.Fprintf(os.Stderr, "preview: %s: no data found for %s\n", p.Name, url)
+		return
+	}
+	if p.Prefix != "" {
+		text = p.Prefix + " | " + text
+	}
+	conn.NoticeN(dst, text, p.MaxLines)
+}
+
+var fieldRegex = regexp.MustCompile(`\{(\w+)(?:\|(\w+))?\}`)
+
+// format returns false if none of the fields used by the format had values.
+func (p *Provider) format(fields map[string]string) (string, bool) {
+	found := false
+	text := fieldRegex.ReplaceAllStringFunc(p.Format, func(s string) string {
+		m := fieldRegex.FindStringSubmatch(s)
+		value := fields[m[1]]
+		if value != "" && m[1] != "url" && m[1] != "key" && m[1] != "fragment" {
+			found = true
+		}
+		if m[2] == "time" {
+			if secs, err := strconv.ParseFloat(value, 64); err == nil {
+				value = formatDuration(time.Duration(secs) * time.Second)
+			} else if d, ok := parseISODuration(value); ok {
+				value = formatDuration(d)
+			}
+		}
+		return value
+	})
+	return text, found
+}
+
+func formatDuration(d time.Duration) string {
+	h, m, s := int(d.Hours()), int(d.Minutes())%60, int(d.Seconds())%60
+	if h > 0 {
+		return fmt.Sprintf("%d:%02d:%02d", h, m, s)
+	}
+	return fmt.Sprintf("%d:%02d", m, s)
+}
+
+var isoDurationRegex = regexp.MustCompile(`^PT(?:(\d+)H)?(?:(\d+)M)?(?:(\d+)S)?$`)
+
+// parseISODuration parses an ISO 8601 duration of the form PT1H2M3S.
+func parseISODuration(s string) (time.Duration, bool) {
+	m := isoDurationRegex.FindStringSubmatch(s)
+	if m == nil || s == "PT" {
+		return 0, false
+	}
+	var d time.Duration
+	for i, unit := range []time.Duration{time.Hour, time.Minute, time.Second} {
+		if n, err := strconv.Atoi(m[i+1]); err == nil {
+			d += time.Duration(n) * unit
+		}
+	}
+	return d, true
+}
+
+func fetchOEmbed(endpoint string, u *url.URL) (map[string]string, error) {
+	var reqURL string
+	if strings.Contains(endpoint, "{url}") {
+		reqURL = strings.Replace(endpoint, "{url}", url.QueryEscape(u.String()), -1)
+	} else {
+		sep := "?"
+		if strings.Contains(endpoint, "?") {
+			sep = "&"
+		}
+		reqURL = endpoint + sep + "format=json&url=" + url.QueryEscape(u.String())
+	}
+	resp, err := plugin.HTTPGet(reqURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("unexpected response: %s", resp.Status)
+	}
+
+	var data map[string]interface{}
+	if err := json.NewDecoder(resp.Body).Decode(&data); err != nil {
+		return nil, err
+	}
+	fields := make(map[string]string, len(data))
+	for key, value := range data {
+		switch value := value.(type) {
+		case string:
+			fields[key] = value
+		case float64:
+			fields[key] = strconv.FormatFloat(value, 'f', -1, 64)
+		case bool:
+			fields[key] = strconv.FormatBool(value)
+		}
+	}
+	return fields, nil
+}
+
+// only the head of the page is usually needed for OpenGraph tags
+const maxPageBytes = 256 << 10
+
+// fetchOpenGraph scrapes the OpenGraph properties of the page, along with the
+// content of the meta tags given by meta.
+func fetchOpenGraph(u *url.URL, meta map[string]string, maxBytes int64) (map[string]string, error) {
+	resp, err := plugin.HTTPGet(u.String())
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("unexpected response: %s", resp.Status)
+	}
+
+	doc, err := html.Parse(io.LimitReader(resp.Body, maxBytes))
+	if err != nil {
+		return nil, err
+	}
+	fields := utils.OpenGraph(doc)
+	if len(fields) == 0 {
+		return nil, errors.New("no OpenGraph properties found")
+	}
+	for field, attr := range meta {
+		i := strings.Index(attr, "=")
+		if value, ok := metaContent(doc, attr[:i], attr[i+1:]); ok {
+			fields[field] = value
+		}
+	}
+	return fields, nil
+}
+
+// metaContent returns the content of the first meta tag whose attribute attr
+// is value.
+func metaContent(n *html.Node, attr, value string) (string, bool) {
+	if n.Type == html.ElementNode && n.DataAtom == atom.Meta && utils.NodeAttr(n, attr) == value {
+		return utils.NodeAttr(n, "content"), true
+	}
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		if content, ok := metaContent(c, attr, value); ok {
+			return content, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,118 @@
+package preview
+
+import (
+	"code.google.com/p/go.net/html"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMatches(t *testing.T) {
+	p := &Provider{
+		Name:  "test",
+		Hosts: []string{"example.com", "*.example.org"},
+		Path:  `^/\d+$`,
+		Key:   `/(\d+)(?:#|$)`,
+	}
+	if err := p.compile(); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		url string
+		ok  bool
+	}{
+		{"https://example.com/123", true},
+		{"http://EXAMPLE.com/123", true},
+		{"https://example.com:443/123", true},
+		{"https://www.example.org/123#t=1", true},
+		{"https://example.org/123", false},
+		{"https://example.com/abc", false},
+		{"ftp://example.com/123", false},
+		{"https://example.com.evil.com/123", false},
+	}
+	for _, test := range tests {
+		u, err := url.Parse(test.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := p.Matches(u); got != test.ok {
+			t.Errorf("Matches(%q) = %v, want %v", test.url, got, test.ok)
+		}
+	}
+}
+
+func TestCompile(t *testing.T) {
+	tests := []Provider{
+		{Name: "path", Hosts: []string{"example.com"}, Path: "("},
+		{Name: "key", Hosts: []string{"example.com"}, Key: "("},
+		{Name: "submatch", Hosts: []string{"example.com"}, Key: "/v/"},
+		{Name: "meta", Hosts: []string{"example.com"}, Meta: map[string]string{"duration": "duration"}},
+		{Name: "host", Hosts: []string{"["}},
+	}
+	for _, p := range tests {
+		if err := p.compile(); err == nil {
+			t.Errorf("provider %q compiled", p.Name)
+		}
+	}
+}
+
+func TestFormat(t *testing.T) {
+	tests := []struct {
+		format string
+		fields map[string]string
+		want   string
+		ok     bool
+	}{
+		{"{title}", map[string]string{"title": "Foo"}, "Foo", true},
+		{"{title} | {url}", map[string]string{"url": "https://x/"}, " | https://x/", false},
+		{"{title} | {duration|time}", map[string]string{"title": "Foo", "duration": "253"}, "Foo | 4:13", true},
+		{"{duration|time}", map[string]string{"duration": "PT1H2M3S"}, "1:02:03", true},
+		{"{duration|time}", map[string]string{"duration": "PT4M13S"}, "4:13", true},
+		{"{duration|time}", map[string]string{"duration": "soon"}, "soon", true},
+		{"{title} | x/{key}{fragment}", map[string]string{"title": "Foo", "key": "abc", "fragment": "#t=30"}, "Foo | x/abc#t=30", true},
+		{"x/{key}{fragment}", map[string]string{"key": "abc", "fragment": "#t=30"}, "x/abc#t=30", false},
+	}
+	for _, test := range tests {
+		p := &Provider{Format: test.format}
+		got, ok := p.format(test.fields)
+		if got != test.want || ok != test.ok {
+			t.Errorf("format(%q, %v) = %q, %v, want %q, %v", test.format, test.fields, got, ok, test.want, test.ok)
+		}
+	}
+}
+
+func TestParseISODuration(t *testing.T) {
+	tests := []struct {
+		s  string
+		d  time.Duration
+		ok bool
+	}{
+		{"PT4M13S", 4*time.Minute + 13*time.Second, true},
+		{"PT1H", time.Hour, true},
+		{"PT0S", 0, true},
+		{"PT", 0, false},
+		{"P1D", 0, false},
+		{"4:13", 0, false},
+	}
+	for _, test := range tests {
+		if d, ok := parseISODuration(test.s); d != test.d || ok != test.ok {
+			t.Errorf("parseISODuration(%q) = %v, %v, want %v, %v", test.s, d, ok, test.d, test.ok)
+		}
+	}
+}
+
+func TestMetaContent(t *testing.T) {
+	page := `<html><head><meta property="og:title" content="Foo"></head>
+<body><div itemscope><meta itemprop="name" content="Foo"><meta itemprop="duration" content="PT4M13S"></div></body></html>`
+	doc, err := html.Parse(strings.NewReader(page))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, ok := metaContent(doc, "itemprop", "duration"); got != "PT4M13S" || !ok {
+		t.Errorf("duration = %q, %v, want PT4M13S", got, ok)
+	}
+	if got, ok := metaContent(doc, "itemprop", "author"); ok {
+		t.Errorf("author = %q, want none", got)
+	}
+}
@@ -3,49 +3,243 @@ package reaction
 import (
 	"../"
 	"../../utils"
+	"../database"
+	"database/sql"
+	"errors"
 	"fmt"
 	"github.com/kballard/gocallback/callback"
 	"github.com/kballard/goirc/irc"
 	"math/rand"
+	"regexp"
 	"strings"
+	"sync"
+	"time"
 )
 
 func init() {
-	plugin.RegisterPlugin("reaction", plugin.Callbacks{Init: setup})
+	database.RegisterMigrations("reaction.db", "reaction",
+		database.Migration{Version: 1, Description: "create triggers table", SQL: []string{
+			"CREATE TABLE IF NOT EXISTS triggers (id integer not null primary key, channel text not null, type text not null, pattern text not null, directed integer not null, responses text not null, creator text not null, created datetime not null)",
+		}, DriverSQL: map[string][]string{"postgres": {
+			"CREATE TABLE IF NOT EXISTS triggers (id bigserial not null primary key, channel text not null, type text not null, pattern text not null, directed integer not null, responses text not null, creator text not null, created timestamptz not null)",
+		}}},
+		database.Migration{Version: 2, Description: "add trigger probability, cooldown and match_case", SQL: []string{
+			"ALTER TABLE triggers ADD COLUMN probability real not null default 0",
+			"ALTER TABLE triggers ADD COLUMN cooldown integer not null default 0",
+			"ALTER TABLE triggers ADD COLUMN match_case integer not null default 0",
+		}, DriverSQL: map[string][]string{"postgres": {
+			"ALTER TABLE triggers ADD COLUMN probability double precision not null default 0",
+			"ALTER TABLE triggers ADD COLUMN cooldown bigint not null default 0",
+			"ALTER TABLE triggers ADD COLUMN match_case integer not null default 0",
+		}}},
+	)
+	plugin.RegisterPlugin("reaction", plugin.Callbacks{Init: setup, Teardown: teardown, Config: &config, Requires: []string{"PRIVMSG", "COMMAND"}})
 }
 
-func setup(reg *callback.Registry, config map[string]interface{}) error {
-	reg.AddCallback("PRIVMSG", func(conn *irc.Conn, line irc.Line, dst, text string) {
-		reply := dst
-		if dst == conn.Me().Nick {
-			reply = line.Src.Nick
-		}
-		if reply == "" {
-			// what, the server sent us a privmsg?
-			return
+// Match types
+const (
+	MatchExact = "exact"
+	MatchGlob  = "glob"
+	MatchRegex = "regex"
+)
+
+// A Trigger reacts to messages that match its pattern with one of its
+// responses.
+type Trigger struct {
+	Pattern string `yaml:"pattern"`
+	// exact (the default), glob or regex. Exact and glob patterns ignore case
+	// and must match the whole message.
+	Type string `yaml:"type"`
+	// Only react to messages addressed to the bot, e.g. "voidbot: botsnack"
+	Directed bool `yaml:"directed"`
+	// One is chosen at random. Responses to regex triggers can refer to
+	// submatches, e.g. $1
+	Responses []string `yaml:"responses"`
+	// Change the case of the response to match the message, e.g. HERP gets
+	// DERP
+	MatchCase bool `yaml:"match_case"`
+	// Only react in these channels, or in all channels if empty
+	Channels []string `yaml:"channels"`
+	// The chance of reacting to a match, from 0 to 1, or always if 0
+	Probability float64 `yaml:"probability"`
+	// Don't react again in the same channel for this long
+	Cooldown time.Duration `yaml:"cooldown"`
+
+	id int64 // in the database, or 0 for triggers from the config
+	re *regexp.Regexp
+}
+
+var config = reactionConfig{
+	Triggers: []Trigger{
+		{Pattern: "herp", Responses: []string{"derp"}, MatchCase: true},
+		{Pattern: "botsnack", Directed: true, Responses: []string{"yum", "nom nom", "om nom nom"}},
+		{Pattern: "<3", Directed: true, Responses: []string{"<3"}},
+	},
+}
+
+type reactionConfig struct {
+	Triggers []Trigger `yaml:"triggers"`
+	// Hostmasks of the users who may add and delete triggers with !trigger,
+	// e.g. *!*@example.com
+	Trusted []string `yaml:"trusted"`
+
+	trusted utils.Hostmasks
+}
+
+func (c *reactionConfig) Validate() error {
+	for i := range c.Triggers {
+		if err := c.Triggers[i].compile(); err != nil {
+			return fmt.Errorf("trigger %q: %v", c.Triggers[i].Pattern, err)
 		}
-		// allow voidbot to be addressed directly, and modify the response
-		prefix := ""
-		isDirected := false
-		if strings.HasPrefix(text, fmt.Sprintf("%s: ", conn.Me().Nick)) {
-			text = text[len(conn.Me().Nick)+2:]
-			prefix = line.Src.Nick + ": "
-			isDirected = true
+	}
+	var err error
+	if c.trusted, err = utils.CompileHostmasks(c.Trusted); err != nil {
+		return fmt.Errorf("trusted: %v", err)
+	}
+	return nil
+}
+
+func (t *Trigger) compile() error {
+	if t.Pattern == "" {
+		return errors.New("pattern is empty")
+	} else if len(t.Responses) == 0 {
+		return errors.New("no responses")
+	} else if t.Probability < 0 || t.Probability > 1 {
+		return errors.New("probability must be between 0 and 1")
+	} else if t.Cooldown < 0 {
+		return errors.New("cooldown must not be negative")
+	}
+	var err error
+	switch t.Type {
+	case "", MatchExact:
+		t.Type = MatchExact
+		t.re, err = regexp.Compile("(?i)^" + regexp.QuoteMeta(t.Pattern) + "$")
+	case MatchGlob:
+		t.re, err = utils.GlobRegexp(t.Pattern)
+	case MatchRegex:
+		t.re, err = regexp.Compile(t.Pattern)
+	default:
+		return fmt.Errorf("type must be %s, %s or %s", MatchExact, MatchGlob, MatchRegex)
+	}
+	return err
+}
+
+func (t *Trigger) inChannel(dst string) bool {
+	if len(t.Channels) == 0 {
+		return true
+	}
+	for _, channel := range t.Channels {
+		if strings.EqualFold(channel, dst) {
+			return true
 		}
-		// implement super awesome reaction logic here
-		if strings.ToLower(text) == "herp" {
-			plugin.Conn(conn).Notice(reply, prefix+utils.MatchCase("derp", text))
-		} else if strings.ToLower(text) == "is me1000 drunk?" || (line.Src.Nick == "Me1000" && strings.ToLower(text) == "am i drunk?") {
-			plugin.Conn(conn).Notice(reply, prefix+randResponse([]string{"yes", "always"}))
-		} else if isDirected && strings.ToLower(text) == "botsnack" {
-			plugin.Conn(conn).Notice(reply, prefix+randResponse([]string{"yum", "nom nom", "om nom nom"}))
-		} else if isDirected && text == "<3" {
-			plugin.Conn(conn).Notice(reply, prefix+"<3")
+	}
+	return false
+}
+
+// respond returns the response to text, which must match.
+func (t *Trigger) respond(text string) string {
+	response := t.Responses[rand.Intn(len(t.Responses))]
+	if t.Type == MatchRegex {
+		indices := t.re.FindStringSubmatchIndex(text)
+		response = string(t.re.ExpandString(nil, response, text, indices))
+	}
+	if t.MatchCase {
+		response = utils.MatchCase(response, text)
+	}
+	return response
+}
+
+type cooldownKey struct {
+	trigger *Trigger
+	dst     string
+}
+
+var state struct {
+	sync.Mutex
+	db        *sql.DB
+	triggers  []*Trigger // from the database
+	lastFired map[cooldownKey]time.Time
+}
+
+func setup(reg *callback.Registry, _ map[string]interface{}) error {
+	db, err := database.OpenNamed("reaction.db")
+	if err != nil {
+		return err
+	}
+	triggers, err := loadTriggers(db)
+	if err != nil {
+		database.Close(db)
+		return err
+	}
+	state.Lock()
+	state.db, state.triggers = db, triggers
+	state.lastFired = make(map[cooldownKey]time.Time)
+	state.Unlock()
+
+	reg.AddCallback("PRIVMSG", func(conn *irc.Conn, line irc.Line, dst, text string) {
+		react(conn, line, dst, text)
+	})
+	reg.AddCallback("COMMAND", func(conn *irc.Conn, line irc.Line, cmd, arg, reply string, isPrivate bool) {
+		if cmd == "trigger" {
+			handleCommand(conn, line, arg, reply, isPrivate)
 		}
 	})
 	return nil
 }
 
-func randResponse(opts []string) string {
-	return opts[rand.Intn(len(opts))]
+func teardown() error {
+	state.Lock()
+	defer state.Unlock()
+	if state.db == nil {
+		return nil
+	}
+	err := database.Close(state.db)
+	state.db, state.triggers = nil, nil
+	return err
+}
+
+func react(conn *irc.Conn, line irc.Line, dst, text string) {
+	if line.Src.Nick == "" {
+		return
+	}
+	// allow voidbot to be addressed directly, and modify the response
+	prefix := ""
+	isDirected := false
+	if strings.HasPrefix(text, fmt.Sprintf("%s: ", conn.Me().Nick)) {
+		text = text[len(conn.Me().Nick)+2:]
+		prefix = line.Src.Nick + ": "
+		isDirected = true
+	}
+
+	if response, ok := match(dst, text, isDirected, time.Now()); ok {
+		plugin.Conn(conn).Notice(dst, prefix+response)
+	}
+}
+
+// match returns the response of the first trigger that matches text and
+// isn't cooling down or skipped by its probability, so that a later trigger
+// can react instead.
+func match(dst, text string, isDirected bool, now time.Time) (string, bool) {
+	state.Lock()
+	defer state.Unlock()
+	triggers := make([]*Trigger, 0, len(config.Triggers)+len(state.triggers))
+	for i := range config.Triggers {
+		triggers = append(triggers, &config.Triggers[i])
+	}
+	triggers = append(triggers, state.triggers...)
+
+	for _, t := range triggers {
+		if (t.Directed && !isDirected) || !t.inChannel(dst) || !t.re.MatchString(text) {
+			continue
+		}
+		key := cooldownKey{t, strings.ToLower(dst)}
+		if now.Sub(state.lastFired[key]) < t.Cooldown {
+			continue
+		} else if t.Probability > 0 && rand.Float64() >= t.Probability {
+			continue
+		}
+		state.lastFired[key] = now
+		return t.respond(text), true
+	}
+	return "", false
 }
@@ -0,0 +1,257 @@
+package reaction
+
+import (
+	"../"
+	"../database"
+	"database/sql"
+	"fmt"
+	"github.com/kballard/goirc/irc"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// the most triggers shown by !trigger list
+const maxListed = 20
+
+// loadTriggers returns the triggers stored in the database, oldest first.
+// Triggers that no longer compile are skipped.
+func loadTriggers(db *sql.DB) ([]*Trigger, error) {
+	rows, err := db.Query("SELECT id, channel, type, pattern, directed, responses, probability, cooldown, match_case FROM triggers ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var triggers []*Trigger
+	for rows.Next() {
+		var t Trigger
+		var channel, responses string
+		var directed, matchCase int
+		var cooldown int64
+		if err := rows.Scan(&t.id, &channel, &t.Type, &t.Pattern, &directed, &responses, &t.Probability, &cooldown, &matchCase); err != nil {
+			return nil, err
+		}
+		t.Directed = directed != 0
+		t.MatchCase = matchCase != 0
+		t.Cooldown = time.Duration(cooldown) * time.Second
+		t.Responses = strings.Split(responses, "\n")
+		if channel != "" {
+			t.Channels = []string{channel}
+		}
+		if err := t.compile(); err != nil {
+			fmt.Fprintf(os.Stderr, "reaction: trigger %d: %v\n", t.id, err)
+			continue
+		}
+		triggers = append(triggers, &t)
+	}
+	return triggers, rows.Err()
+}
+
+const usage = "usage: !trigger add [-directed] [-global] [-match_case] [-probability p] [-cooldown duration] pattern = response [| response...], !trigger del id, !trigger list"
+
+func handleCommand(conn *irc.Conn, line irc.Line, arg, reply string, isPrivate bool) {
+	words := strings.SplitN(strings.TrimSpace(arg), " ", 2)
+	subcmd, rest := strings.ToLower(words[0]), ""
+	if len(words) > 1 {
+		rest = strings.TrimSpace(words[1])
+	}
+	var msg string
+	var err error
+	switch subcmd {
+	case "add", "del":
+		if !trusted(line.Src.Raw) {
+			msg = "you aren't allowed to change triggers"
+		} else if subcmd == "add" {
+			msg, err = addTrigger(line, rest, reply, isPrivate)
+		} else {
+			msg, err = deleteTrigger(rest)
+		}
+	case "list":
+		listTriggers(conn, line, reply, isPrivate)
+		return
+	default:
+		msg = usage
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "reaction:", err)
+		msg = "error: " + err.Error()
+	}
+	plugin.Conn(conn).Notice(reply, msg)
+}
+
+func trusted(src string) bool {
+	return config.trusted.Match(src)
+}
+
+// addTrigger parses [-directed] [-global] [-match_case] [-probability p]
+// [-cooldown duration] pattern = response | response. A pattern of the form
+// /regex/ is a regex, and one containing * or ? is a glob. Triggers added in a
+// channel only apply there, unless -global is given.
+func addTrigger(line irc.Line, arg, reply string, isPrivate bool) (string, error) {
+	t := Trigger{Type: MatchExact}
+	global := isPrivate
+flags:
+	for {
+		words := strings.SplitN(arg, " ", 3)
+		if len(words) < 2 {
+			break
+		}
+		switch words[0] {
+		case "-directed":
+			t.Directed = true
+		case "-global":
+			global = true
+		case "-match_case":
+			t.MatchCase = true
+		case "-probability", "-cooldown":
+			if len(words) < 3 {
+				return usage, nil
+			}
+			var err error
+			if words[0] == "-probability" {
+				t.Probability, err = strconv.ParseFloat(words[1], 64)
+			} else {
+				t.Cooldown, err = time.ParseDuration(words[1])
+			}
+			if err != nil {
+				return fmt.Sprintf("invalid %s %q", words[0][1:], words[1]), nil
+			}
+			arg = strings.TrimSpace(words[2])
+			continue
+		default:
+			break flags
+		}
+		arg = strings.TrimSpace(arg[len(words[0]):])
+	}
+	i := strings.Index(arg, " = ")
+	if i < 0 {
+		return usage, nil
+	}
+	t.Pattern = strings.TrimSpace(arg[:i])
+	for _, response := range strings.Split(arg[i+3:], "|") {
+		if response = strings.TrimSpace(response); response != "" {
+			t.Responses = append(t.Responses, response)
+		}
+	}
+	if len(t.Pattern) > 2 && strings.HasPrefix(t.Pattern, "/") && strings.HasSuffix(t.Pattern, "/") {
+		t.Type, t.Pattern = MatchRegex, t.Pattern[1:len(t.Pattern)-1]
+	} else if strings.ContainsAny(t.Pattern, "*?") {
+		t.Type = MatchGlob
+	}
+	channel := ""
+	if !global {
+		channel = reply
+		t.Channels = []string{channel}
+	}
+	if err := t.compile(); err != nil {
+		return "invalid trigger: " + err.Error(), nil
+	}
+
+	state.Lock()
+	defer state.Unlock()
+	if state.db == nil {
+		return "", fmt.Errorf("database is closed")
+	}
+	tx, err := state.db.Begin()
+	if err != nil {
+		return "", err
+	}
+	directed, matchCase := 0, 0
+	if t.Directed {
+		directed = 1
+	}
+	if t.MatchCase {
+		matchCase = 1
+	}
+	sqlstr := "INSERT INTO triggers (channel, type, pattern, directed, responses, creator, created, probability, cooldown, match_case) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)"
+	t.id, err = database.Insert(tx, sqlstr, channel, t.Type, t.Pattern, directed, strings.Join(t.Responses, "\n"), line.Src.Nick, time.Now(), t.Probability, int64(t.Cooldown/time.Second), matchCase)
+	if err != nil {
+		tx.Rollback()
+		return "", err
+	} else if err := tx.Commit(); err != nil {
+		return "", err
+	}
+	state.triggers = append(state.triggers, &t)
+	return fmt.Sprintf("added trigger %d", t.id), nil
+}
+
+func deleteTrigger(arg string) (string, error) {
+	id, err := strconv.ParseInt(strings.TrimPrefix(arg, "#"), 10, 64)
+	if err != nil {
+		return usage, nil
+	}
+	state.Lock()
+	defer state.Unlock()
+	if state.db == nil {
+		return "", fmt.Errorf("database is closed")
+	}
+	res, err := state.db.Exec("DELETE FROM triggers WHERE id = ?", id)
+	if err != nil {
+		return "", err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return "", err
+	} else if n == 0 {
+		return fmt.Sprintf("no trigger %d", id), nil
+	}
+	for i, t := range state.triggers {
+		if t.id == id {
+			state.triggers = append(state.triggers[:i:i], state.triggers[i+1:]...)
+			break
+		}
+	}
+	return fmt.Sprintf("deleted trigger %d", id), nil
+}
+
+// listTriggers sends the triggers that apply in the channel privately, as
+// there may be many.
+func listTriggers(conn *irc.Conn, line irc.Line, reply string, isPrivate bool) {
+	state.Lock()
+	var lines []string
+	for _, t := range state.triggers {
+		if isPrivate || t.inChannel(reply) {
+			lines = append(lines, describe(t))
+		}
+	}
+	state.Unlock()
+
+	nick := line.Src.Nick
+	if len(config.Triggers) > 0 {
+		plugin.Conn(conn).Notice(nick, fmt.Sprintf("%d triggers are set in the config file", len(config.Triggers)))
+	}
+	if len(lines) == 0 {
+		plugin.Conn(conn).Notice(nick, "no triggers have been added")
+		return
+	}
+	if len(lines) > maxListed {
+		lines = append(lines[:maxListed], fmt.Sprintf("...and %d more", len(lines)-maxListed))
+	}
+	for _, msg := range lines {
+		plugin.Conn(conn).Notice(nick, msg)
+	}
+}
+
+func describe(t *Trigger) string {
+	scope := "global"
+	if len(t.Channels) > 0 {
+		scope = strings.Join(t.Channels, ",")
+	}
+	if t.Directed {
+		scope += ", directed"
+	}
+	if t.MatchCase {
+		scope += ", match_case"
+	}
+	if t.Probability > 0 {
+		scope += fmt.Sprintf(", probability %g", t.Probability)
+	}
+	if t.Cooldown > 0 {
+		scope += fmt.Sprintf(", cooldown %s", t.Cooldown)
+	}
+	pattern := t.Pattern
+	if t.Type == MatchRegex {
+		pattern = "/" + pattern + "/"
+	}
+	return fmt.Sprintf("%d [%s] %s = %s", t.id, scope, pattern, strings.Join(t.Responses, " | "))
+}
@@ -0,0 +1,184 @@
+package sed
+
+import (
+	"../../utils"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// A command is a correction of the form s/pattern/replacement/flags or
+// y/source/dest/, optionally followed by @nick to correct someone else. Any
+// ASCII punctuation other than \ and @ can be used in place of /.
+type command struct {
+	// s or y
+	op byte
+	// for s
+	re          *regexp.Regexp
+	replacement string
+	global      bool
+	occurrence  int
+	// for y
+	from, to []rune
+	// the nick to correct, or "" for the sender
+	target string
+}
+
+var nickRegex = regexp.MustCompile("^" + utils.NickRegex.String() + "$")
+
+// parseCommand returns nil if text isn't a correction, or an error if it
+// looks like one but is invalid.
+func parseCommand(text string) (*command, error) {
+	text = strings.TrimRightFunc(text, isSpace)
+	if len(text) < 2 || (text[0] != 's' && text[0] != 'y') || !isDelimiter(text[1]) {
+		return nil, nil
+	}
+	c := &command{op: text[0]}
+	delim := text[1]
+	fields, rest, ok := splitFields(text[2:], delim, 2)
+	if !ok || fields[0] == "" {
+		return nil, nil
+	}
+	if config.MaxPatternLength > 0 && len(fields[0]) > config.MaxPatternLength {
+		return nil, limitError("pattern is too long")
+	}
+
+	flags := rest
+	if i := strings.IndexByte(rest, '@'); i >= 0 {
+		flags, c.target = rest[:i], rest[i+1:]
+		if !nickRegex.MatchString(c.target) {
+			return nil, nil
+		}
+	}
+
+	if c.op == 'y' {
+		if flags != "" {
+			return nil, nil
+		}
+		c.from = []rune(unescape(fields[0], delim))
+		c.to = []rune(unescape(fields[1], delim))
+		if len(c.from) != len(c.to) {
+			return nil, fmt.Errorf("y%c%s%c%s%c: strings are different lengths", delim, fields[0], delim, fields[1], delim)
+		}
+		return c, nil
+	}
+
+	ignorecase := false
+	for i := 0; i < len(flags); i++ {
+		switch ch := flags[i]; {
+		case ch == 'i':
+			ignorecase = true
+		case ch == 'g':
+			c.global = true
+		case ch >= '1' && ch <= '9' && c.occurrence == 0:
+			j := i + 1
+			for j < len(flags) && flags[j] >= '0' && flags[j] <= '9' {
+				j++
+			}
+			n, err := strconv.Atoi(flags[i:j])
+			if err != nil {
+				return nil, nil
+			}
+			c.occurrence = n
+			i = j - 1
+		default:
+			return nil, nil
+		}
+	}
+
+	pat := fields[0]
+	if ignorecase {
+		pat = "(?i)" + pat
+	}
+	re, err := regexp.Compile(pat)
+	if err != nil {
+		return nil, fmt.Errorf("bad regexp %s: %v", pat, err)
+	}
+	c.re = re
+	c.replacement = unescape(fields[1], delim)
+	return c, nil
+}
+
+func isDelimiter(b byte) bool {
+	return b < utf8.RuneSelf && b > ' ' && b != 0x7f && b != '\\' && b != '@' &&
+		!(b >= 'a' && b <= 'z') && !(b >= 'A' && b <= 'Z') && !(b >= '0' && b <= '9')
+}
+
+func isSpace(r rune) bool {
+	return r == ' ' || r == '\t'
+}
+
+// splitFields splits s into n fields, each terminated by an unescaped delim,
+// and returns the remainder. Escapes are left in the fields.
+func splitFields(s string, delim byte, n int) ([]string, string, bool) {
+	var fields []string
+	start := 0
+	for i := 0; i < len(s) && len(fields) < n; i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case delim:
+			fields = append(fields, s[start:i])
+			start = i + 1
+		}
+	}
+	if len(fields) < n {
+		return nil, "", false
+	}
+	return fields, s[start:], true
+}
+
+// unescape removes the backslash from escaped delimiters.
+func unescape(s string, delim byte) string {
+	return strings.Replace(s, `\`+string(delim), string(delim), -1)
+}
+
+// matches reports whether the command would change msg.
+func (c *command) matches(msg string) bool {
+	if c.op == 'y' {
+		return strings.ContainsAny(msg, string(c.from))
+	}
+	n := c.occurrence
+	if n == 0 {
+		n = 1
+	}
+	return len(c.re.FindAllStringIndex(msg, n)) == n
+}
+
+// apply returns msg with the correction applied. With an occurrence n only
+// the nth match is replaced, or every match from the nth with g. Replacing
+// stops once the result is longer than maxLength, as it will be truncated.
+func (c *command) apply(msg string, maxLength int) string {
+	if c.op == 'y' {
+		return strings.Map(func(r rune) rune {
+			for i, from := range c.from {
+				if r == from {
+					return c.to[i]
+				}
+			}
+			return r
+		}, msg)
+	}
+
+	first := c.occurrence
+	if first == 0 {
+		first = 1
+	}
+	var result []byte
+	last := 0
+	for i, indices := range c.re.FindAllStringSubmatchIndex(msg, -1) {
+		if len(result) > maxLength {
+			return string(result)
+		} else if i+1 < first {
+			continue
+		} else if i+1 > first && !c.global {
+			break
+		}
+		result = append(result, msg[last:indices[0]]...)
+		result = c.re.ExpandString(result, c.replacement, msg, indices)
+		last = indices[1]
+	}
+	return string(append(result, msg[last:]...))
+}
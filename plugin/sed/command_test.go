@@ -0,0 +1,93 @@
+package sed
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseCommand(t *testing.T) {
+	tests := []struct {
+		text    string
+		ok      bool // a command, rather than nil
+		invalid bool // an error, rather than a command
+		target  string
+	}{
+		{"s/foo/bar/", true, false, ""},
+		{"s/foo/bar", false, false, ""},
+		{"s//bar/", false, false, ""},
+		{"s/foo/bar/gi", true, false, ""},
+		{"s/foo/bar/2g", true, false, ""},
+		{"s/foo/bar/x", false, false, ""},
+		{"s/foo/bar/@alice", true, false, "alice"},
+		{"s/foo/bar/@#chan", false, false, ""},
+		{"s|a/b|c|", true, false, ""},
+		{"s#foo#bar#  ", true, false, ""},
+		{"sxfooxbarx", false, false, ""},
+		{`s\foo\bar\`, false, false, ""},
+		{"s/(/x/", false, true, ""},
+		{"y/abc/xyz/", true, false, ""},
+		{"y/abc/xy/", false, true, ""},
+		{"y/abc/xyz/g", false, false, ""},
+		{"hello", false, false, ""},
+		{"s/" + strings.Repeat("a", 300) + "/b/", false, true, ""},
+	}
+	for _, test := range tests {
+		c, err := parseCommand(test.text)
+		if test.invalid {
+			if err == nil {
+				t.Errorf("parseCommand(%q) returned no error", test.text)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseCommand(%q): %v", test.text, err)
+		} else if (c != nil) != test.ok {
+			t.Errorf("parseCommand(%q) = %v, want a command: %v", test.text, c, test.ok)
+		} else if c != nil && c.target != test.target {
+			t.Errorf("parseCommand(%q) target = %q, want %q", test.text, c.target, test.target)
+		}
+	}
+}
+
+func TestApply(t *testing.T) {
+	tests := []struct {
+		cmd, msg string
+		matches  bool
+		want     string
+	}{
+		{"s/o/0/", "foo boo", true, "f0o boo"},
+		{"s/o/0/g", "foo boo", true, "f00 b00"},
+		{"s/o/0/2", "foo boo", true, "fo0 boo"},
+		{"s/o/0/3g", "foo boo", true, "foo b00"},
+		{"s/o/0/5", "foo boo", false, ""},
+		{"s/O/0/ig", "fOo", true, "f00"},
+		{`s/(\w+) (\w+)/$2 $1/`, "hello world", true, "world hello"},
+		{`s/a\/b/c/`, "a/b", true, "c"},
+		{"s|/|-|g", "a/b/c", true, "a-b-c"},
+		{"s/x/y/", "foo", false, ""},
+		{"y/abc/xyz/", "aabbcc", true, "xxyyzz"},
+		{"y/é/e/", "café", true, "cafe"},
+		{"y/q/z/", "foo", false, ""},
+	}
+	for _, test := range tests {
+		c, err := parseCommand(test.cmd)
+		if c == nil || err != nil {
+			t.Errorf("parseCommand(%q) = %v, %v", test.cmd, c, err)
+			continue
+		}
+		if got := c.matches(test.msg); got != test.matches {
+			t.Errorf("%q matches %q = %v, want %v", test.cmd, test.msg, got, test.matches)
+		} else if got && c.apply(test.msg, 400) != test.want {
+			t.Errorf("%q applied to %q = %q, want %q", test.cmd, test.msg, c.apply(test.msg, 400), test.want)
+		}
+	}
+}
+
+func TestApplyStopsAtMaxLength(t *testing.T) {
+	c, _ := parseCommand("s/a/aaaa/g")
+	// replacing stops once the result is over the limit, as it'll be
+	// truncated anyway
+	if got, want := c.apply(strings.Repeat("a", 100), 10), strings.Repeat("a", 12); got != want {
+		t.Errorf("apply = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,103 @@
+package sed
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// What to do when a correction is refused for exceeding a limit
+const (
+	PolicyIgnore = "ignore"
+	PolicyWarn   = "warn"
+)
+
+// A limitError is reported to the user under the warn policy.
+type limitError string
+
+func (e limitError) Error() string {
+	return string(e)
+}
+
+// recent corrections by each nick, for rate limiting
+var rates struct {
+	sync.Mutex
+	byNick map[string][]time.Time
+	warned map[string]bool
+}
+
+func init() {
+	rates.byNick = make(map[string][]time.Time)
+	rates.warned = make(map[string]bool)
+}
+
+// allowCorrection records a correction by nick, returning an error if nick
+// has made too many recently. Only the first refusal in each period is
+// reported, so that warnings can't be used to flood; later ones return
+// errSilent.
+func allowCorrection(nick string, now time.Time) error {
+	if config.RateLimit <= 0 {
+		return nil
+	}
+	rates.Lock()
+	defer rates.Unlock()
+	// forget nicks that haven't made a correction recently
+	for other, times := range rates.byNick {
+		if now.Sub(times[len(times)-1]) >= config.RatePeriod {
+			delete(rates.byNick, other)
+			delete(rates.warned, other)
+		}
+	}
+	var recent []time.Time
+	for _, t := range rates.byNick[nick] {
+		if now.Sub(t) < config.RatePeriod {
+			recent = append(recent, t)
+		}
+	}
+	if len(recent) >= config.RateLimit {
+		rates.byNick[nick] = recent
+		if rates.warned[nick] {
+			return errSilent
+		}
+		rates.warned[nick] = true
+		return limitError(fmt.Sprintf("too many corrections, try again in %s", (config.RatePeriod - now.Sub(recent[0])).Truncate(time.Second)))
+	}
+	rates.byNick[nick] = append(recent, now)
+	delete(rates.warned, nick)
+	return nil
+}
+
+var errSilent = limitError("")
+
+// evaluate finds the most recent line that c matches and corrects it, giving
+// up after the configured timeout. It returns the index of the line, or -1 if
+// none matched. Go's regexps run in linear time, so a correction that times
+// out still finishes in the background.
+func evaluate(c *command, lines []Line, maxLength int) (int, string, error) {
+	type evaluation struct {
+		i      int
+		result string
+	}
+	done := make(chan evaluation, 1)
+	go func() {
+		for i := len(lines) - 1; i >= 0; i-- {
+			if c.matches(lines[i].Msg) {
+				done <- evaluation{i, c.apply(lines[i].Msg, maxLength)}
+				return
+			}
+		}
+		done <- evaluation{-1, ""}
+	}()
+	if config.Timeout <= 0 {
+		e := <-done
+		return e.i, e.result, nil
+	}
+	timer := time.NewTimer(config.Timeout)
+	defer timer.Stop()
+	select {
+	case e := <-done:
+		return e.i, e.result, nil
+	case <-timer.C:
+		return -1, "", limitError("correction took too long")
+	}
+}
@@ -0,0 +1,116 @@
+package sed
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAllowCorrection(t *testing.T) {
+	defer func(c sedConfig) { config = c }(config)
+	config.RateLimit, config.RatePeriod = 2, time.Minute
+	rates.byNick = make(map[string][]time.Time)
+	rates.warned = make(map[string]bool)
+	now := time.Now()
+
+	tests := []struct {
+		nick  string
+		after time.Duration
+		want  string // ok, warn or silent
+	}{
+		{"alice", 0, "ok"},
+		{"alice", time.Second, "ok"},
+		{"alice", 2 * time.Second, "warn"},
+		{"alice", 3 * time.Second, "silent"},
+		{"bob", 3 * time.Second, "ok"},
+		{"alice", time.Minute + time.Second, "ok"},
+		{"alice", time.Minute + 2*time.Second, "ok"},
+		{"alice", time.Minute + 3*time.Second, "warn"},
+	}
+	for i, test := range tests {
+		got := "warn"
+		switch err := allowCorrection(test.nick, now.Add(test.after)); err {
+		case nil:
+			got = "ok"
+		case errSilent:
+			got = "silent"
+		}
+		if got != test.want {
+			t.Errorf("%d: correction by %s after %s: got %s, want %s", i, test.nick, test.after, got, test.want)
+		}
+	}
+}
+
+func TestRatesArePruned(t *testing.T) {
+	defer func(c sedConfig) { config = c }(config)
+	config.RateLimit, config.RatePeriod = 1, time.Minute
+	rates.byNick = make(map[string][]time.Time)
+	rates.warned = make(map[string]bool)
+	now := time.Now()
+
+	allowCorrection("alice", now)
+	allowCorrection("alice", now)
+	allowCorrection("bob", now.Add(time.Minute+time.Second))
+	rates.Lock()
+	_, counted := rates.byNick["alice"]
+	_, warned := rates.warned["alice"]
+	rates.Unlock()
+	if counted || warned {
+		t.Errorf("alice is still tracked after a quiet period: counted %v, warned %v", counted, warned)
+	}
+}
+
+func TestValidateOutputLength(t *testing.T) {
+	for _, n := range []int{0, 3, 400} {
+		c := config
+		c.MaxOutputLength = n
+		if err := c.Validate(); err != nil {
+			t.Errorf("max_output_length %d: %v", n, err)
+		}
+	}
+	for _, n := range []int{-1, 1, 2} {
+		c := config
+		c.MaxOutputLength = n
+		if err := c.Validate(); err == nil {
+			t.Errorf("max_output_length %d was accepted", n)
+		}
+	}
+}
+
+func TestEvaluate(t *testing.T) {
+	defer func(c sedConfig) { config = c }(config)
+	config.Timeout = time.Second
+	lines := []Line{{Msg: "foo bar"}, {Msg: "foo baz"}, {Msg: "qux"}}
+
+	tests := []struct {
+		cmd    string
+		i      int
+		result string
+	}{
+		{"s/foo/FOO/", 1, "FOO baz"},
+		{"s/bar/BAR/", 0, "foo BAR"},
+		{"y/q/Q/", 2, "Qux"},
+		{"s/nope/x/", -1, ""},
+		{"s/o/" + strings.Repeat("o", 50) + "/g", 1, "f" + strings.Repeat("o", 50)},
+	}
+	for _, test := range tests {
+		c, _ := parseCommand(test.cmd)
+		i, result, err := evaluate(c, lines, 20)
+		if err != nil || i != test.i || result != test.result {
+			t.Errorf("evaluate(%q) = %d, %q, %v, want %d, %q", test.cmd, i, result, err, test.i, test.result)
+		}
+	}
+}
+
+func TestPatternLength(t *testing.T) {
+	defer func(c sedConfig) { config = c }(config)
+	config.MaxPatternLength = 5
+	if _, err := parseCommand("s/abcde/x/"); err != nil {
+		t.Errorf("pattern at the limit: %v", err)
+	}
+	if _, err := parseCommand("s/abcdef/x/"); err == nil {
+		t.Error("pattern over the limit was accepted")
+	} else if _, ok := err.(limitError); !ok {
+		t.Errorf("pattern over the limit: got %T, want limitError", err)
+	}
+}
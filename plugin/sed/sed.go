@@ -3,14 +3,80 @@ package sed
 import (
 	".."
 	"../../utils"
+	"../store"
+	"errors"
 	"fmt"
 	"github.com/kballard/gocallback/callback"
 	"github.com/kballard/goirc/irc"
-	"regexp"
+	"sync"
+	"time"
 )
 
+// The sed plugin corrects recent lines with s/// and y///. If redispatch is
+// set, each correction is also dispatched as a CORRECTION event, so that URLs
+// in it can be previewed:
+//
+//	func(conn *irc.Conn, line irc.Line, dst, text string)
+//
+// where line is the message that made the correction.
+
 func init() {
-	plugin.RegisterPlugin("sed", plugin.Callbacks{Init: setup, NewConnection: newConnection})
+	plugin.RegisterPlugin("sed", plugin.Callbacks{Init: setup, Teardown: teardown, NewConnection: newConnection, Config: &config, Requires: []string{"PRIVMSG", "ACTION", "OUTGOING"}, Provides: []string{"CORRECTION"}})
+}
+
+var config = sedConfig{
+	History:          10,
+	MaxPatternLength: 256,
+	MaxOutputLength:  400,
+	Timeout:          100 * time.Millisecond,
+	RateLimit:        5,
+	RatePeriod:       time.Minute,
+	Policy:           PolicyIgnore,
+}
+
+type sedConfig struct {
+	// How many recent lines of each nick can be corrected
+	History int `yaml:"history"`
+	// Remember the lines across restarts
+	Persist bool `yaml:"persist"`
+	// Dispatch each correction as a CORRECTION event, so that URLs in it are
+	// previewed
+	Redispatch bool `yaml:"redispatch"`
+
+	// Corrections with longer patterns are refused
+	MaxPatternLength int `yaml:"max_pattern_length"`
+	// Longer results are truncated, as are results that don't fit in a
+	// notice
+	MaxOutputLength int `yaml:"max_output_length"`
+	// Corrections that take longer are abandoned, or never if 0
+	Timeout time.Duration `yaml:"timeout"`
+	// Each nick may make rate_limit corrections per rate_period, or any
+	// number if 0
+	RateLimit  int           `yaml:"rate_limit"`
+	RatePeriod time.Duration `yaml:"rate_period"`
+	// What to do when a correction is refused for exceeding a limit: ignore
+	// it, or warn the user
+	Policy string `yaml:"policy"`
+}
+
+func (c *sedConfig) Validate() error {
+	if c.History <= 0 {
+		return errors.New("history must be positive")
+	} else if c.MaxPatternLength < 0 || c.MaxOutputLength < 0 || c.RateLimit < 0 {
+		return errors.New("limits must not be negative")
+	} else if c.Timeout < 0 || c.RatePeriod < 0 {
+		return errors.New("durations must not be negative")
+	} else if c.RateLimit > 0 && c.RatePeriod == 0 {
+		return errors.New("rate_period is required with rate_limit")
+	} else if c.MaxOutputLength > 0 && c.MaxOutputLength < len("...") {
+		return errors.New("max_output_length must leave room for the ellipsis")
+	}
+	switch c.Policy {
+	case PolicyIgnore, PolicyWarn:
+	default:
+		return fmt.Errorf("policy must be %s or %s", PolicyIgnore, PolicyWarn)
+	}
+	return nil
 }
 
 type Line struct {
@@ -18,45 +84,131 @@ type Line struct {
 	Action bool
 }
 
-var channels map[string]map[string]Line // map[channel name]map[nickname]Line
+// recent lines, oldest first
+var history struct {
+	sync.Mutex
+	channels map[string]map[string][]Line // map[channel name]map[nickname][]Line
+}
+
+var kv = store.New("sed")
 
-var sedRegex = regexp.MustCompile(`^s/((?:\\.|[^/])+)/((?:\\.|[^/])*)/([ig]*)(?:@(` + utils.NickRegex.String() + `))?\s*$`)
+var pluginReg *callback.Registry
 
-func setup(reg *callback.Registry, config map[string]interface{}) error {
-	channels = make(map[string]map[string]Line)
+// persisted history is forgotten if the bot isn't restarted within this long
+const persistTTL = 24 * time.Hour
+
+func setup(reg *callback.Registry, _ map[string]interface{}) error {
+	pluginReg = reg
+	history.Lock()
+	history.channels = make(map[string]map[string][]Line)
+	history.Unlock()
+	if config.Persist {
+		if err := loadHistory(); err != nil {
+			return err
+		}
+	}
 	reg.AddCallback("PRIVMSG", func(conn *irc.Conn, line irc.Line, dst, text string) {
-		if line.Src.Nick == "" {
-			return
+		handleLine(conn, line, dst, text, false)
+	})
+	reg.AddCallback("ACTION", func(conn *irc.Conn, line irc.Line, dst, text string, isPrivate bool) {
+		if !isPrivate {
+			handleLine(conn, line, dst, text, true)
 		}
-		if matches := sedRegex.FindStringSubmatch(text); matches != nil {
-			processMatches(conn, line, dst, matches)
-		} else {
-			lines := channels[dst]
-			if lines == nil {
-				lines = make(map[string]Line)
-				channels[dst] = lines
-			}
-			lines[line.Src.Nick] = Line{Msg: text, Action: false}
+	})
+	// the bot's own lines can be corrected too
+	reg.AddCallback("OUTGOING", func(conn *irc.Conn, dst, text, kind string) {
+		if utils.IsChannelName(dst) {
+			addLine(dst, conn.Me().Nick, Line{Msg: text, Action: kind == "ACTION"})
 		}
 	})
-	reg.AddCallback("ACTION", func(conn *irc.Conn, line irc.Line, dst, text string, isPrivate bool) {
-		if line.Src.Nick == "" || isPrivate {
-			return
+	return nil
+}
+
+func teardown() error {
+	pluginReg = nil
+	if config.Persist {
+		return saveHistory()
+	}
+	return nil
+}
+
+func loadHistory() error {
+	kv := kv.Network()
+	keys, err := kv.List("")
+	if err != nil {
+		return err
+	}
+	history.Lock()
+	defer history.Unlock()
+	for _, channel := range keys {
+		var lines map[string][]Line
+		if ok, err := kv.Get(channel, &lines); err != nil {
+			return err
+		} else if ok {
+			for nick, recent := range lines {
+				if len(recent) > config.History {
+					lines[nick] = recent[len(recent)-config.History:]
+				}
+			}
+			history.channels[channel] = lines
 		}
-		if matches := sedRegex.FindStringSubmatch(text); matches != nil {
-			processMatches(conn, line, dst, matches)
-		} else {
-			lines := channels[dst]
-			if lines == nil {
-				lines = make(map[string]Line)
-				channels[dst] = lines
+	}
+	return nil
+}
+
+func saveHistory() error {
+	kv := kv.Network()
+	keys, err := kv.List("")
+	if err != nil {
+		return err
+	}
+	history.Lock()
+	defer history.Unlock()
+	for _, channel := range keys {
+		if len(history.channels[channel]) == 0 {
+			if err := kv.Delete(channel); err != nil {
+				return err
 			}
-			lines[line.Src.Nick] = Line{Msg: text, Action: true}
 		}
-	})
+	}
+	for channel, lines := range history.channels {
+		if len(lines) > 0 {
+			if err := kv.SetTTL(channel, lines, persistTTL); err != nil {
+				return err
+			}
+		}
+	}
 	return nil
 }
 
+func handleLine(conn *irc.Conn, line irc.Line, dst, text string, action bool) {
+	if line.Src.Nick == "" {
+		return
+	}
+	if c, err := parseCommand(text); err != nil {
+		refuse(conn, dst, line.Src.Nick, err)
+	} else if c != nil {
+		processCommand(conn, line, dst, c)
+	} else {
+		addLine(dst, line.Src.Nick, Line{Msg: text, Action: action})
+	}
+}
+
+func addLine(dst, nick string, line Line) {
+	history.Lock()
+	defer history.Unlock()
+	lines := history.channels[dst]
+	if lines == nil {
+		lines = make(map[string][]Line)
+		history.channels[dst] = lines
+	}
+	recent := append(lines[nick], line)
+	if len(recent) > config.History {
+		recent = append([]Line(nil), recent[len(recent)-config.History:]...)
+	}
+	lines[nick] = recent
+}
+
 func newConnection(reg irc.HandlerRegistry) {
 	reg.AddHandler("PART", func(conn *irc.Conn, line irc.Line) {
 		if len(line.Args) < 1 {
@@ -66,7 +218,9 @@ func newConnection(reg irc.HandlerRegistry) {
 			return
 		}
 		dst := line.Args[0]
-		if lines, ok := channels[dst]; ok {
+		history.Lock()
+		defer history.Unlock()
+		if lines, ok := history.channels[dst]; ok {
 			delete(lines, line.Src.Nick)
 		}
 	})
@@ -74,7 +228,9 @@ func newConnection(reg irc.HandlerRegistry) {
 		if line.Src.Nick == "" {
 			return
 		}
-		for _, lines := range channels {
+		history.Lock()
+		defer history.Unlock()
+		for _, lines := range history.channels {
 			delete(lines, line.Src.Nick)
 		}
 	})
@@ -84,7 +240,9 @@ func newConnection(reg irc.HandlerRegistry) {
 		}
 		dst := line.Args[0]
 		nick := line.Args[1]
-		if lines, ok := channels[dst]; ok {
+		history.Lock()
+		defer history.Unlock()
+		if lines, ok := history.channels[dst]; ok {
 			delete(lines, nick)
 		}
 	})
@@ -94,76 +252,95 @@ func newConnection(reg irc.HandlerRegistry) {
 		}
 		src := line.Src.Nick
 		nick := line.Args[0]
-		for _, lines := range channels {
-			if line, ok := lines[src]; ok {
-				lines[nick] = line
+		history.Lock()
+		defer history.Unlock()
+		for _, lines := range history.channels {
+			if recent, ok := lines[src]; ok {
+				lines[nick] = recent
 				delete(lines, src)
 			}
 		}
 	})
 }
 
-func processMatches(conn *irc.Conn, line irc.Line, dst string, matches []string) {
-	if lines := channels[dst]; lines != nil {
-		nick := line.Src.Nick
-		src := matches[4]
-		isSelf := false
-		if src == "" {
-			src = nick
-			isSelf = true
-		}
-		if line, ok := lines[src]; ok {
-			pat := matches[1]
-			ignorecase, global := false, false
-			if matches[3] != "" {
-				for _, c := range matches[3] {
-					switch c {
-					case 'i':
-						ignorecase = true
-					case 'g':
-						global = true
-					}
-				}
-			}
-			if ignorecase {
-				pat = "(?i)" + pat
-			}
-			re, err := regexp.Compile(pat)
-			if err != nil {
-				fmt.Printf("sed: bad regexp %s: %v\n", pat, err)
-				return
-			}
-			var result string
-			if global {
-				result = re.ReplaceAllString(line.Msg, matches[2])
-			} else {
-				indices := re.FindStringSubmatchIndex(line.Msg)
-				if indices == nil {
-					return
-				}
-				bresult := []byte(line.Msg[0:indices[0]])
-				bresult = re.ExpandString(bresult, matches[2], line.Msg, indices)
-				bresult = append(bresult, line.Msg[indices[1]:]...)
-				result = string(bresult)
-			}
-			if result != line.Msg {
-				if isSelf {
-					line.Msg = result
-					lines[src] = line
-				}
-				if line.Action {
-					result = src + " " + result
-				}
-				infix := "meant"
-				if !isSelf {
-					infix = fmt.Sprintf("thinks %s meant", src)
-				}
-				conn.Notice(dst, fmt.Sprintf("%s %s: %s", nick, infix, result))
-			} else {
-				fmt.Printf("sed: non-matching regexp %s against nick %s\n", pat, src)
+// processCommand corrects the most recent line of the target that the
+// command matches.
+func processCommand(conn *irc.Conn, line irc.Line, dst string, c *command) {
+	nick := line.Src.Nick
+	src := c.target
+	isSelf := false
+	if src == "" {
+		src = nick
+		isSelf = true
+	}
+
+	history.Lock()
+	recent := append([]Line(nil), history.channels[dst][src]...)
+	history.Unlock()
+	if len(recent) == 0 {
+		fmt.Printf("sed: no history known for nick %s\n", src)
+		return
+	}
+	if err := allowCorrection(nick, time.Now()); err != nil {
+		refuse(conn, dst, nick, err)
+		return
+	}
+
+	prefix := nick + " meant: "
+	if !isSelf {
+		prefix = fmt.Sprintf("%s thinks %s meant: ", nick, src)
+	}
+	maxLength := plugin.AllowedNoticeTextLength(dst) - len(prefix) - len(src) - 1
+	if config.MaxOutputLength > 0 && config.MaxOutputLength < maxLength {
+		maxLength = config.MaxOutputLength
+	}
+	i, result, err := evaluate(c, recent, maxLength)
+	if err != nil {
+		refuse(conn, dst, nick, err)
+		return
+	} else if i < 0 {
+		fmt.Printf("sed: no line of nick %s matches\n", src)
+		return
+	}
+	old := recent[i]
+	if result == old.Msg {
+		return
+	}
+	if len(result) > maxLength {
+		result = utils.Truncate(result, maxLength-len("..."))
+	}
+	if isSelf {
+		history.Lock()
+		// lines may have been added since
+		lines := history.channels[dst][src]
+		for j := len(lines) - 1; j >= 0; j-- {
+			if lines[j] == old {
+				lines[j].Msg = result
+				break
 			}
-		} else {
-			fmt.Printf("sed: no history known for nick %s\n", src)
 		}
+		history.Unlock()
+	}
+
+	corrected := result
+	if old.Action {
+		corrected = src + " " + result
+	}
+	plugin.Conn(conn).Notice(dst, prefix+corrected)
+
+	if reg := pluginReg; config.Redispatch && reg != nil {
+		// the corrected line is attributed to whoever corrected it
+		reg.Dispatch("CORRECTION", conn, line, dst, corrected)
+	}
+}
+
+// refuse reports a correction that couldn't be made.
+func refuse(conn *irc.Conn, dst, nick string, err error) {
+	if err == errSilent {
+		return
+	}
+	fmt.Println("sed:", err)
+	if _, ok := err.(limitError); ok && config.Policy == PolicyWarn {
+		plugin.Conn(conn).Notice(dst, nick+": "+err.Error())
 	}
 }
@@ -2,18 +2,19 @@ package stocks
 
 import (
 	"../"
+	"../cache"
 	"encoding/xml"
 	"fmt"
 	"github.com/kballard/gocallback/callback"
 	"github.com/kballard/goirc/irc"
-	"net/http"
 	"net/url"
 	"regexp"
 	"strings"
+	"time"
 )
 
 func init() {
-	plugin.RegisterPlugin("stocks", plugin.Callbacks{Init: setup})
+	plugin.RegisterPlugin("stocks", plugin.Callbacks{Init: setup, Requires: []string{"PRIVMSG"}})
 }
 
 var stockRegex = regexp.MustCompile("\\$[A-Z]{1,5}\\b");
@@ -58,28 +59,18 @@ func setup(reg *callback.Registry, config map[string]interface{}) error {
 	return nil
 }
 
+// quotes are only cached briefly, since they change constantly
+var quoteCache = cache.New("stocks", time.Minute)
+
 func queryStocks(stocks []string, conn plugin.IrcConn, reply string) {
-	query := buildQuery(stocks)
-	req := fmt.Sprintf("http://query.yahooapis.com/v1/public/yql?q=%s&env=%s", url.QueryEscape(query), url.QueryEscape("store://datatables.org/alltableswithkeys"))
-	resp, err := http.Get(req)
-	if err != nil {
-		fmt.Println("stocks:", err)
-		return
-	}
-	defer resp.Body.Close()
-	if resp.StatusCode != 200 {
-		fmt.Printf("stocks: unexpected code %d for query %s", resp.StatusCode, req)
-		return
-	}
 	var result QueryResult
-	if err := xml.NewDecoder(resp.Body).Decode(&result); err != nil {
+	err := quoteCache.Get(strings.Join(stocks, ","), &result, func() (interface{}, error) {
+		return fetchQuotes(stocks)
+	})
+	if err != nil {
 		fmt.Println("stocks:", err)
 		return
 	}
-	if len(result.Quotes) == 0 {
-		fmt.Println("stocks: Got no quotes back for query", req)
-		return
-	}
 	quotes := formatQuotes(result.Quotes)
 	if len(quotes) == 0 {
 		return
@@ -108,6 +99,27 @@ func queryStocks(stocks []string, conn plugin.IrcConn, reply string) {
 	}
 }
 
+func fetchQuotes(stocks []string) (QueryResult, error) {
+	query := buildQuery(stocks)
+	req := fmt.Sprintf("http://query.yahooapis.com/v1/public/yql?q=%s&env=%s", url.QueryEscape(query), url.QueryEscape("store://datatables.org/alltableswithkeys"))
+	resp, err := plugin.HTTPGet(req)
+	if err != nil {
+		return QueryResult{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return QueryResult{}, fmt.Errorf("unexpected code %d for query %s", resp.StatusCode, req)
+	}
+	var result QueryResult
+	if err := xml.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return QueryResult{}, err
+	}
+	if len(result.Quotes) == 0 {
+		return QueryResult{}, fmt.Errorf("Got no quotes back for query %s", req)
+	}
+	return result, nil
+}
+
 func buildQuery(stocks []string) string {
 	quoted := make([]string, len(stocks))
 	for i, stock := range stocks {
@@ -0,0 +1,170 @@
+package store
+
+import (
+	"../database"
+	"database/sql"
+	"encoding/json"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// A Store is a namespace of persistent key/value pairs, for plugins that need
+// to remember simple state across restarts without writing SQL. Values are
+// stored as JSON in store.db, so they must survive a round trip through
+// encoding/json. Each plugin should use its own Store, which can be narrowed
+// to the current network or to a channel.
+type Store struct {
+	namespace string
+}
+
+func init() {
+	database.RegisterMigrations("store.db", "store",
+		database.Migration{Version: 1, Description: "create kv table", SQL: []string{
+			"CREATE TABLE IF NOT EXISTS kv (namespace text not null, key text not null, value blob not null, expires datetime, primary key (namespace, key))",
+		}, DriverSQL: map[string][]string{"postgres": {
+			"CREATE TABLE IF NOT EXISTS kv (namespace text not null, key text not null, value bytea not null, expires timestamptz, primary key (namespace, key))",
+		}}},
+	)
+}
+
+var state struct {
+	sync.Mutex
+	network string
+	db      *sql.DB
+}
+
+// SetNetwork sets the name of the network used by Network and Channel,
+// typically the server name.
+func SetNetwork(network string) {
+	state.Lock()
+	defer state.Unlock()
+	state.network = strings.ToLower(network)
+}
+
+// Close closes the database, if it was opened.
+func Close() error {
+	state.Lock()
+	defer state.Unlock()
+	if state.db == nil {
+		return nil
+	}
+	err := database.Close(state.db)
+	state.db = nil
+	return err
+}
+
+// New returns the store for the given name, typically the plugin name.
+func New(name string) *Store {
+	return &Store{namespace: name}
+}
+
+// Network returns a store for keys specific to the current network.
+func (s *Store) Network() *Store {
+	state.Lock()
+	defer state.Unlock()
+	return &Store{namespace: s.namespace + "/" + state.network}
+}
+
+// Channel returns a store for keys specific to a channel on the current
+// network.
+func (s *Store) Channel(channel string) *Store {
+	return &Store{namespace: s.Network().namespace + "/" + strings.ToLower(channel)}
+}
+
+func open() (*sql.DB, error) {
+	state.Lock()
+	defer state.Unlock()
+	if state.db == nil {
+		db, err := database.OpenNamed("store.db")
+		if err != nil {
+			return nil, err
+		}
+		if _, err := db.Exec("DELETE FROM kv WHERE expires < ?", time.Now()); err != nil {
+			database.Close(db)
+			return nil, err
+		}
+		state.db = db
+	}
+	return state.db, nil
+}
+
+// Get decodes the value stored for key into value. It returns false if
+// there is no value or it has expired.
+func (s *Store) Get(key string, value interface{}) (bool, error) {
+	db, err := open()
+	if err != nil {
+		return false, err
+	}
+	var data []byte
+	sqlstr := "SELECT value FROM kv WHERE namespace = ? AND key = ? AND (expires IS NULL OR expires > ?)"
+	if err := db.QueryRow(sqlstr, s.namespace, key, time.Now()).Scan(&data); err == sql.ErrNoRows {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return true, json.Unmarshal(data, value)
+}
+
+// Set stores value for key, replacing any previous value.
+func (s *Store) Set(key string, value interface{}) error {
+	return s.set(key, value, nil)
+}
+
+// SetTTL stores value for key, to be forgotten after ttl.
+func (s *Store) SetTTL(key string, value interface{}, ttl time.Duration) error {
+	expires := time.Now().Add(ttl)
+	return s.set(key, value, &expires)
+}
+
+func (s *Store) set(key string, value interface{}, expires *time.Time) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	db, err := open()
+	if err != nil {
+		return err
+	}
+	sqlstr := "INSERT INTO kv (namespace, key, value, expires) VALUES (?, ?, ?, ?) ON CONFLICT (namespace, key) DO UPDATE SET value = excluded.value, expires = excluded.expires"
+	if expires != nil {
+		_, err = db.Exec(sqlstr, s.namespace, key, data, *expires)
+	} else {
+		_, err = db.Exec(sqlstr, s.namespace, key, data, nil)
+	}
+	return err
+}
+
+// Delete removes the value for key, if any.
+func (s *Store) Delete(key string) error {
+	db, err := open()
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec("DELETE FROM kv WHERE namespace = ? AND key = ?", s.namespace, key)
+	return err
+}
+
+// List returns the keys that have the given prefix, in sorted order.
+func (s *Store) List(prefix string) ([]string, error) {
+	db, err := open()
+	if err != nil {
+		return nil, err
+	}
+	sqlstr := "SELECT key FROM kv WHERE namespace = ? AND substr(key, 1, ?) = ? AND (expires IS NULL OR expires > ?) ORDER BY key"
+	rows, err := db.Query(sqlstr, s.namespace, utf8.RuneCountInString(prefix), prefix, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var keys []string
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
@@ -0,0 +1,186 @@
+package store
+
+import (
+	"../database"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func setup(t *testing.T) func() {
+	dir, err := ioutil.TempDir("", "store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	database.SetDataDir(dir)
+	SetNetwork("irc.example.net")
+	return func() {
+		if err := Close(); err != nil {
+			t.Error(err)
+		}
+		database.SetDataDir(".")
+		os.RemoveAll(dir)
+	}
+}
+
+func TestSetGet(t *testing.T) {
+	defer setup(t)()
+
+	s := New("test")
+	type value struct {
+		Name  string
+		Count int
+	}
+	var v value
+	if ok, err := s.Get("missing", &v); err != nil || ok {
+		t.Errorf("Get(missing) = %v, %v; want false, nil", ok, err)
+	}
+	want := value{"one", 1}
+	if err := s.Set("key", want); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := s.Get("key", &v); err != nil || !ok || v != want {
+		t.Errorf("Get(key) = %v, %v, %+v; want true, nil, %+v", ok, err, v, want)
+	}
+	want = value{"two", 2}
+	if err := s.Set("key", want); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := s.Get("key", &v); err != nil || !ok || v != want {
+		t.Errorf("Get(key) after replacing = %v, %v, %+v; want true, nil, %+v", ok, err, v, want)
+	}
+	if err := s.Delete("key"); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := s.Get("key", &v); err != nil || ok {
+		t.Errorf("Get(key) after Delete = %v, %v; want false, nil", ok, err)
+	}
+}
+
+func TestNamespaces(t *testing.T) {
+	defer setup(t)()
+
+	stores := []*Store{
+		New("test"),
+		New("other"),
+		New("test").Network(),
+		New("test").Channel("#chan"),
+		New("test").Channel("#other"),
+	}
+	for i, s := range stores {
+		if err := s.Set("key", i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i, s := range stores {
+		var got int
+		if ok, err := s.Get("key", &got); err != nil || !ok || got != i {
+			t.Errorf("%s: Get(key) = %v, %v, %d; want true, nil, %d", s.namespace, ok, err, got, i)
+		}
+	}
+	if a, b := New("test").Channel("#Chan").namespace, New("test").Channel("#chan").namespace; a != b {
+		t.Errorf("channel namespaces %q and %q differ by case", a, b)
+	}
+}
+
+func TestList(t *testing.T) {
+	defer setup(t)()
+
+	s := New("test")
+	for _, key := range []string{"b/2", "a/1", "b/1", "bb", "é/1"} {
+		if err := s.Set(key, true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := New("other").Set("b/3", true); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		prefix string
+		want   []string
+	}{
+		{"", []string{"a/1", "b/1", "b/2", "bb", "é/1"}},
+		{"b/", []string{"b/1", "b/2"}},
+		{"é", []string{"é/1"}},
+		{"c", nil},
+	}
+	for _, test := range tests {
+		got, err := s.List(test.prefix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("List(%q) = %q, want %q", test.prefix, got, test.want)
+		}
+	}
+}
+
+func TestTTL(t *testing.T) {
+	defer setup(t)()
+
+	s := New("test")
+	if err := s.SetTTL("expired", 1, -time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetTTL("short", 1, 50*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetTTL("long", 1, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Set("forever", 1); err != nil {
+		t.Fatal(err)
+	}
+	var v int
+	if ok, err := s.Get("expired", &v); err != nil || ok {
+		t.Errorf("Get(expired) = %v, %v; want false, nil", ok, err)
+	}
+	if ok, err := s.Get("short", &v); err != nil || !ok {
+		t.Errorf("Get(short) = %v, %v; want true, nil", ok, err)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	if ok, err := s.Get("short", &v); err != nil || ok {
+		t.Errorf("Get(short) after its ttl = %v, %v; want false, nil", ok, err)
+	}
+	if got, err := s.List(""); err != nil || !reflect.DeepEqual(got, []string{"forever", "long"}) {
+		t.Errorf("List() = %q, %v; want [forever long], nil", got, err)
+	}
+
+	// Set forgets the ttl
+	if err := s.SetTTL("short", 2, 50*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Set("short", 3); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if ok, err := s.Get("short", &v); err != nil || !ok || v != 3 {
+		t.Errorf("Get(short) after Set = %v, %v, %d; want true, nil, 3", ok, err, v)
+	}
+
+	// expired rows are deleted when the store is reopened
+	if err := s.SetTTL("short", 4, -time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if err := Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Get("forever", &v); err != nil {
+		t.Fatal(err)
+	}
+	db, err := database.OpenNamed("store.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer database.Close(db)
+	var count int
+	if err := db.QueryRow("SELECT COUNT(*) FROM kv").Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	if count != 2 {
+		t.Errorf("%d rows after reopening, want 2", count)
+	}
+}
@@ -0,0 +1,180 @@
+package title
+
+import (
+	"../"
+	"../../utils"
+	"../cache"
+	"../urlevent"
+	"bufio"
+	"code.google.com/p/go.net/html"
+	"code.google.com/p/go.net/html/atom"
+	"fmt"
+	"github.com/kballard/gocallback/callback"
+	"github.com/kballard/goirc/irc"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// The title plugin posts the title of web pages for URLs that weren't claimed
+// by one of the site-specific plugins.
+
+var config = struct {
+	// If non-empty, only these hosts (and their subdomains) are previewed
+	Whitelist []string `yaml:"whitelist"`
+	// These hosts (and their subdomains) are never previewed
+	Blacklist []string `yaml:"blacklist"`
+	// The maximum number of bytes of each page to read
+	MaxBytes int64 `yaml:"max_bytes"`
+}{
+	MaxBytes: 256 << 10,
+}
+
+func init() {
+	plugin.RegisterPlugin("title", plugin.Callbacks{Init: setup, Config: &config, Requires: []string{"UNCLAIMED_URL"}})
+}
+
+type Page struct {
+	Title       string
+	Description string
+}
+
+func (p Page) String() string {
+	if p.Description != "" && p.Description != p.Title {
+		return p.Title + " - " + p.Description
+	}
+	return p.Title
+}
+
+func setup(reg *callback.Registry, _ map[string]interface{}) error {
+	reg.AddCallback("UNCLAIMED_URL", func(conn *irc.Conn, line irc.Line, dst string, url *url.URL, claim *urlevent.Claim) {
+		if url.Scheme == "http" || url.Scheme == "https" {
+			if shouldPreview(strings.ToLower(url.Host)) && claim.Take("title") {
+				go processURL(plugin.Conn(conn), dst, url)
+			}
+		}
+	})
+	return nil
+}
+
+func shouldPreview(host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	for _, pattern := range config.Blacklist {
+		if matchHost(host, pattern) {
+			return false
+		}
+	}
+	if len(config.Whitelist) == 0 {
+		return true
+	}
+	for _, pattern := range config.Whitelist {
+		if matchHost(host, pattern) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchHost returns whether host is pattern or a subdomain of it.
+func matchHost(host, pattern string) bool {
+	pattern = strings.ToLower(pattern)
+	return host == pattern || strings.HasSuffix(host, "."+pattern)
+}
+
+var pageCache = cache.New("title", time.Hour)
+
+// Lookup returns the title and description of the page at url. Pages that
+// aren't HTML have no title. Lookup works whether or not the title plugin is
+// enabled.
+func Lookup(url *url.URL) (Page, error) {
+	var page Page
+	err := pageCache.Get(url.String(), &page, func() (interface{}, error) {
+		return fetchPage(url)
+	})
+	return page, err
+}
+
+func processURL(conn plugin.IrcConn, dst string, url *url.URL) {
+	page, err := Lookup(url)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "title:", err)
+		return
+	}
+	if page.Title == "" {
+		return
+	}
+
+	prefix := "\00314" + url.Host + "\017 | "
+	text := strings.Join(strings.Fields(page.String()), " ")
+	maxLength := plugin.AllowedNoticeTextLength(dst) - len(prefix)
+	if len(text) > maxLength {
+		text = utils.Truncate(text, maxLength-len("..."))
+	}
+	conn.Notice(dst, prefix+text)
+}
+
+// fetchPage returns an empty Page (and no error) for non-HTML resources.
+func fetchPage(url *url.URL) (Page, error) {
+	resp, err := plugin.HTTPGet(url.String())
+	if err != nil {
+		return Page{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return Page{}, fmt.Errorf("unexpected response: %s", resp.Status)
+	}
+
+	r := bufio.NewReader(io.LimitReader(resp.Body, config.MaxBytes))
+	contentType := resp.Header.Get("Content-Type")
+	if contentType == "" {
+		peek, _ := r.Peek(512)
+		contentType = http.DetectContentType(peek)
+	}
+	if mediaType, _, err := mime.ParseMediaType(contentType); err != nil || (mediaType != "text/html" && mediaType != "application/xhtml+xml") {
+		return Page{}, nil
+	}
+
+	doc, err := html.Parse(r)
+	if err != nil {
+		return Page{}, err
+	}
+	return parsePage(doc), nil
+}
+
+func parsePage(doc *html.Node) Page {
+	var title string
+	var f func(*html.Node) bool
+	f = func(n *html.Node) bool {
+		if n.Type == html.ElementNode {
+			if n.DataAtom == atom.Title {
+				title = utils.NodeString(n)
+				return true
+			} else if n.DataAtom == atom.Body {
+				// the title belongs in the head
+				return false
+			}
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			if f(c) {
+				return true
+			}
+		}
+		return false
+	}
+	f(doc)
+
+	og := utils.OpenGraph(doc)
+	page := Page{Title: strings.TrimSpace(title), Description: strings.TrimSpace(og["description"])}
+	if og["title"] != "" {
+		page.Title = strings.TrimSpace(og["title"])
+	}
+	return page
+}
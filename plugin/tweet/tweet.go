@@ -3,14 +3,16 @@ package tweet
 import (
 	"../"
 	"../../utils"
+	"../cache"
+	"../urlevent"
 	"code.google.com/p/go.net/html"
 	"fmt"
 	"github.com/kballard/gocallback/callback"
 	"github.com/kballard/goirc/irc"
-	"net/http"
 	"net/url"
 	"os"
 	"strings"
+	"time"
 	"unicode"
 )
 
@@ -30,18 +32,16 @@ func (t Tweet) Valid() bool {
 }
 
 func init() {
-	plugin.RegisterPlugin("tweet", plugin.Callbacks{Init: setupTweet})
+	plugin.RegisterPlugin("tweet", plugin.Callbacks{Init: setupTweet, Requires: []string{"URL"}})
 }
 
 func setupTweet(reg *callback.Registry, config map[string]interface{}) error {
-	reg.AddCallback("URL", func(conn *irc.Conn, line irc.Line, dst string, url *url.URL) {
+	urlevent.AddClaimer(func(conn *irc.Conn, line irc.Line, dst string, url *url.URL, claim *urlevent.Claim) {
 		if url.Scheme == "http" || url.Scheme == "https" {
 			if url.Host == "twitter.com" || url.Host == "www.twitter.com" {
-				if url.Fragment != "noquote" {
-					username, tweet_id := parseTwitterURL(url)
-					if username != "" && tweet_id != "" {
-						go processTweetURL(plugin.Conn(conn), line, dst, username, tweet_id)
-					}
+				username, tweet_id := parseTwitterURL(url)
+				if username != "" && tweet_id != "" && claim.Take("tweet") {
+					go processTweetURL(plugin.Conn(conn), line, dst, username, tweet_id)
 				}
 			}
 		}
@@ -61,24 +61,36 @@ func parseTwitterURL(url *url.URL) (username, tweet_id string) {
 	return
 }
 
+var tweetCache = cache.New("tweet", 24*time.Hour)
+
 func processTweetURL(conn plugin.IrcConn, line irc.Line, dst, username, tweet_id string) {
-	url := fmt.Sprintf("http://twitter.com/%s/status/%s", username, tweet_id)
-	resp, err := http.Get(url)
+	var tweet Tweet
+	err := tweetCache.Get(username+"/"+tweet_id, &tweet, func() (interface{}, error) {
+		return fetchTweet(username, tweet_id)
+	})
 	if err != nil {
-		fmt.Fprintln(os.Stderr, err)
+		fmt.Fprintln(os.Stderr, "tweet:", err)
 		return
 	}
+
+	conn.NoticeN(dst, "\00310,01\002Twitter\017 | "+tweet.String(), 4)
+}
+
+func fetchTweet(username, tweet_id string) (Tweet, error) {
+	url := fmt.Sprintf("http://twitter.com/%s/status/%s", username, tweet_id)
+	resp, err := plugin.HTTPGet(url)
+	if err != nil {
+		return Tweet{}, err
+	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != 200 {
-		fmt.Fprintln(os.Stderr, "tweet: unexpected response:", resp)
-		return
+		return Tweet{}, fmt.Errorf("unexpected response: %s", resp.Status)
 	}
 
 	doc, err := html.Parse(resp.Body)
 	if err != nil {
-		fmt.Fprintln(os.Stderr, err)
-		return
+		return Tweet{}, err
 	}
 
 	var tweet Tweet
@@ -121,9 +133,8 @@ func processTweetURL(conn plugin.IrcConn, line irc.Line, dst, username, tweet_id
 	}
 	f(doc)
 
-	if tweet.Valid() {
-		conn.NoticeN(dst, "\00310,01\002Twitter\017 | "+tweet.String(), 4)
-	} else {
-		fmt.Println("Could not find tweet in page", url)
+	if !tweet.Valid() {
+		return Tweet{}, fmt.Errorf("could not find tweet in page %s", url)
 	}
+	return tweet, nil
 }
@@ -0,0 +1,146 @@
+package unshorten
+
+import (
+	"../"
+	"../cache"
+	"../urlevent"
+	"errors"
+	"fmt"
+	"github.com/kballard/gocallback/callback"
+	"github.com/kballard/goirc/irc"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// The unshorten plugin follows links from URL shorteners, posts where they
+// lead, and dispatches a URL event for the destination so that it can be
+// previewed by the other plugins. The short link and its destination each
+// count towards urlevent's max_previews. Links that lead to an error page are
+// reported as dead. Like all plugin requests, redirects to private addresses
+// aren't followed unless the http section of the config allows them.
+
+var config = struct {
+	// Shortener hosts whose links are followed
+	Hosts []string `yaml:"hosts"`
+	// The maximum number of redirects to follow
+	MaxHops int `yaml:"max_hops"`
+	// Report links that lead to a 4xx or 5xx response
+	ReportDead bool `yaml:"report_dead"`
+}{
+	Hosts: []string{
+		"bit.ly", "j.mp", "t.co", "goo.gl", "tinyurl.com", "ow.ly", "buff.ly",
+		"is.gd", "v.gd", "tiny.cc", "dlvr.it", "lnkd.in", "fb.me", "amzn.to",
+		"trib.al", "shorturl.at", "rebrand.ly",
+	},
+	MaxHops:    5,
+	ReportDead: true,
+}
+
+func init() {
+	plugin.RegisterPlugin("unshorten", plugin.Callbacks{Init: setup, Config: &config, Requires: []string{"URL"}})
+}
+
+func setup(reg *callback.Registry, _ map[string]interface{}) error {
+	urlevent.AddClaimer(func(conn *irc.Conn, line irc.Line, dst string, url *url.URL, claim *urlevent.Claim) {
+		if (url.Scheme == "http" || url.Scheme == "https") && isShortener(url.Hostname()) && claim.Take("unshorten") {
+			go processURL(conn, line, dst, url, claim)
+		}
+	})
+	return nil
+}
+
+func isShortener(host string) bool {
+	host = strings.TrimPrefix(strings.ToLower(host), "www.")
+	for _, h := range config.Hosts {
+		if strings.EqualFold(h, host) {
+			return true
+		}
+	}
+	return false
+}
+
+// A Destination is where a short link leads. Status is the final response
+// status if it was an error.
+type Destination struct {
+	URL    string
+	Status string
+}
+
+var destCache = cache.New("unshorten", 24*time.Hour)
+
+func processURL(conn *irc.Conn, line irc.Line, dst string, u *url.URL, claim *urlevent.Claim) {
+	var dest Destination
+	err := destCache.Get(u.String(), &dest, func() (interface{}, error) {
+		return resolve(u)
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "unshorten: %s: %v\n", u, err)
+		return
+	}
+	prefix := "\00314" + u.Host + "\017 | "
+	if dest.Status != "" {
+		if config.ReportDead {
+			plugin.Conn(conn).Notice(dst, fmt.Sprintf("%s%s (dead link: %s)", prefix, dest.URL, dest.Status))
+		}
+		return
+	}
+	destURL, err := url.Parse(dest.URL)
+	if err != nil || dest.URL == u.String() {
+		return
+	}
+	plugin.Conn(conn).Notice(dst, prefix+dest.URL)
+	claim.Redirect(conn, line, dst, destURL)
+}
+
+// resolve follows redirects from u until it reaches a page that doesn't
+// redirect, giving up after MaxHops or if a URL repeats.
+func resolve(u *url.URL) (Destination, error) {
+	seen := map[string]bool{u.String(): true}
+	for hop := 0; ; hop++ {
+		resp, err := request("HEAD", u)
+		if err == nil && (resp.StatusCode >= 400 && resp.StatusCode < 500 || resp.StatusCode == http.StatusNotImplemented) {
+			// some servers don't support HEAD, or refuse it with any 4xx
+			resp, err = request("GET", u)
+		}
+		if err != nil {
+			return Destination{}, err
+		}
+
+		switch {
+		case resp.StatusCode >= 300 && resp.StatusCode < 400 && resp.Header.Get("Location") != "":
+			loc, err := u.Parse(resp.Header.Get("Location"))
+			if err != nil {
+				return Destination{}, fmt.Errorf("invalid redirect: %v", err)
+			}
+			if seen[loc.String()] {
+				return Destination{}, errors.New("redirect loop")
+			}
+			if hop >= config.MaxHops {
+				return Destination{}, fmt.Errorf("stopped after %d redirects", config.MaxHops)
+			}
+			seen[loc.String()] = true
+			u = loc
+		case resp.StatusCode >= 400:
+			return Destination{URL: u.String(), Status: resp.Status}, nil
+		default:
+			return Destination{URL: u.String()}, nil
+		}
+	}
+}
+
+func request(method string, u *url.URL) (*http.Response, error) {
+	req, err := http.NewRequest(method, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := plugin.HTTPDoNoRedirect(req)
+	if err != nil {
+		return nil, err
+	}
+	// only the status and headers are needed
+	resp.Body.Close()
+	return resp, nil
+}
@@ -0,0 +1,216 @@
+package urlevent
+
+import (
+	"../"
+	"github.com/kballard/gocallback/callback"
+	"github.com/kballard/goirc/irc"
+	"net/url"
+	"regexp"
+	"sync"
+)
+
+// The urlevent plugin finds URLs in channel messages, actions and topic
+// changes, and dispatches a URL event for each distinct URL:
+//
+//	func(conn *irc.Conn, line irc.Line, dst string, url *url.URL, claim *urlevent.Claim)
+//
+// Plugins that post a preview of the URL register a Claimer with AddClaimer
+// instead of handling the URL event. Claimers are called synchronously before
+// the URL event is dispatched, and must Take the claim, skipping the preview if
+// that fails. If no claimer took the claim, an UNCLAIMED_URL event with the
+// same arguments is dispatched afterwards for generic fallbacks.
+//
+// Claimers and the handlers of both events may be called from any goroutine,
+// as URLs that a claimer Redirects are dispatched from the goroutine that
+// called Redirect.
+//
+// URLs in corrections made by the sed plugin are dispatched too, with a claim
+// whose Corrected method returns true, as nobody actually posted them.
+//
+// It is enabled automatically for any plugin that requires URL events.
+
+var config = struct {
+	// The maximum number of previews posted for a single message
+	MaxPreviews int `yaml:"max_previews"`
+}{
+	MaxPreviews: 3,
+}
+
+func init() {
+	plugin.RegisterPlugin("urlevent", plugin.Callbacks{Init: setup, NewConnection: newConnection, Teardown: teardown, Config: &config, Requires: []string{"PRIVMSG", "ACTION"}, Provides: []string{"URL", "UNCLAIMED_URL"}})
+}
+
+var URLRegex = regexp.MustCompile("(?i)\\b((?:[a-z][\\w-]+:(?:/{1,3}|[a-z0-9%])|www\\d{0,3}[.]|[a-z0-9.\\-]+[.][a-z]{2,4}/)(?:[^\\s()<>]+|\\(([^\\s()<>]+|(\\([^\\s()<>]+\\)))*\\))+(?:\\(([^\\s()<>]+|(\\([^\\s()<>]+\\)))*\\)|[^\\s`!()\\[\\]{};:'\".,<>?«»“”‘’]))")
+
+var pluginReg *callback.Registry
+
+func setup(reg *callback.Registry, config map[string]interface{}) error {
+	pluginReg = reg
+	reg.AddCallback("PRIVMSG", func(conn *irc.Conn, line irc.Line, dst, text string) {
+		dispatchURLs(conn, line, dst, text, false)
+	})
+	reg.AddCallback("ACTION", func(conn *irc.Conn, line irc.Line, dst, text string, isPrivate bool) {
+		if !isPrivate {
+			dispatchURLs(conn, line, dst, text, false)
+		}
+	})
+	reg.AddCallback("CORRECTION", func(conn *irc.Conn, line irc.Line, dst, text string) {
+		dispatchURLs(conn, line, dst, text, true)
+	})
+	return nil
+}
+
+func teardown() error {
+	pluginReg = nil
+	claimers.Lock()
+	claimers.list = nil
+	claimers.Unlock()
+	return nil
+}
+
+func newConnection(reg irc.HandlerRegistry) {
+	reg.AddHandler("TOPIC", func(conn *irc.Conn, line irc.Line) {
+		if len(line.Args) < 2 || line.SrcIsMe() {
+			return
+		}
+		dispatchURLs(conn, line, line.Args[0], line.Args[1], false)
+	})
+}
+
+func dispatchURLs(conn *irc.Conn, line irc.Line, dst, text string, corrected bool) {
+	msg := &message{optOut: optOutRegex.MatchString(text), corrected: corrected}
+	for _, u := range ExtractURLs(text) {
+		dispatchURL(conn, line, dst, &Claim{msg: msg, url: u})
+	}
+}
+
+// A Claimer decides whether to preview a URL, and if so must Take the claim
+// before returning. It's called by whichever goroutine dispatches the URL,
+// possibly concurrently with other URLs, so it must only read state that
+// doesn't change after Init. Slow work such as fetching the preview belongs in
+// a new goroutine.
+type Claimer func(conn *irc.Conn, line irc.Line, dst string, url *url.URL, claim *Claim)
+
+var claimers struct {
+	sync.Mutex
+	list []Claimer
+}
+
+// AddClaimer registers a plugin that previews URLs. Claimers are offered each
+// URL in the order they were added. It should be called from the plugin's
+// Init.
+func AddClaimer(f Claimer) {
+	claimers.Lock()
+	defer claimers.Unlock()
+	claimers.list = append(claimers.list, f)
+}
+
+func dispatchURL(conn *irc.Conn, line irc.Line, dst string, claim *Claim) {
+	claimers.Lock()
+	list := claimers.list
+	claimers.Unlock()
+	// every claimer has returned, so the claim's owner is settled before
+	// deciding whether the URL is unclaimed
+	for _, f := range list {
+		f(conn, line, dst, claim.url, claim)
+	}
+
+	reg := pluginReg
+	if reg == nil {
+		return
+	}
+	reg.Dispatch("URL", conn, line, dst, claim.url, claim)
+	if claim.Owner() == "" {
+		reg.Dispatch("UNCLAIMED_URL", conn, line, dst, claim.url, claim)
+	}
+}
+
+// the maximum number of times a URL can be redirected with Redirect
+const maxRedirects = 3
+
+// Users can suppress previews for a single URL with a #noquote or #nopreview
+// fragment, or for a whole message by including the word nopreview.
+var optOutRegex = regexp.MustCompile(`(?i)\bnopreview\b`)
+
+type message struct {
+	sync.Mutex
+	previews  int
+	optOut    bool
+	corrected bool
+}
+
+// A Claim is passed along with each URL event. The first claimer to Take it
+// is responsible for previewing the URL.
+type Claim struct {
+	msg       *message
+	url       *url.URL
+	owner     string
+	redirects int
+	via       *url.URL
+}
+
+// Take claims the URL for the named plugin. It returns false if the URL was
+// already claimed, if the user opted out of previews, or if the message has
+// reached its preview limit, in which case no preview should be posted.
+func (c *Claim) Take(name string) bool {
+	c.msg.Lock()
+	defer c.msg.Unlock()
+	if c.owner != "" || c.msg.optOut || c.url.Fragment == "noquote" || c.url.Fragment == "nopreview" {
+		return false
+	}
+	if c.msg.previews >= config.MaxPreviews {
+		return false
+	}
+	c.msg.previews++
+	c.owner = name
+	return true
+}
+
+// Owner returns the name of the plugin that took the claim, if any.
+func (c *Claim) Owner() string {
+	c.msg.Lock()
+	defer c.msg.Unlock()
+	return c.owner
+}
+
+// Via returns the URL that redirected to this one, or nil if the URL was
+// posted directly.
+func (c *Claim) Via() *url.URL {
+	return c.via
+}
+
+// Corrected returns whether the URL is from a correction of an earlier
+// message, rather than being posted directly.
+func (c *Claim) Corrected() bool {
+	return c.msg.corrected
+}
+
+// Redirect dispatches a new URL event for u, the destination the claimed URL
+// redirects to, so that it can be previewed in turn. It counts towards the
+// original message's preview limit, as does the claimed URL, so a message's
+// redirected links use up two previews each. Chains of more than a few
+// redirects are ignored. Redirect may be called from any goroutine, and runs
+// the claimers and dispatches the events on it.
+func (c *Claim) Redirect(conn *irc.Conn, line irc.Line, dst string, u *url.URL) {
+	if c.redirects >= maxRedirects {
+		return
+	}
+	dispatchURL(conn, line, dst, &Claim{msg: c.msg, url: u, redirects: c.redirects + 1, via: c.url})
+}
+
+// ExtractURLs returns the absolute URLs found in text, in order, with
+// duplicates removed.
+func ExtractURLs(text string) []*url.URL {
+	var urls []*url.URL
+	seen := make(map[string]bool)
+	for _, submatches := range URLRegex.FindAllStringSubmatch(text, -1) {
+		urlStr := submatches[1]
+		if u, err := url.Parse(urlStr); err == nil && u.Host != "" {
+			if !seen[u.String()] {
+				seen[u.String()] = true
+				urls = append(urls, u)
+			}
+		}
+	}
+	return urls
+}
@@ -0,0 +1,105 @@
+package urlevent
+
+import (
+	"github.com/kballard/goirc/irc"
+	"net/url"
+	"sync"
+	"testing"
+)
+
+func TestOnePreviewPerURL(t *testing.T) {
+	defer teardown()
+
+	tests := []struct {
+		text     string
+		previews int
+	}{
+		{"see http://example.com/a", 1},
+		{"http://example.com/a http://example.com/a", 1},
+		{"http://example.com/a http://example.com/b", 2},
+		{"http://a.com/ http://b.com/ http://c.com/ http://d.com/", 3},
+		{"http://example.com/a nopreview", 0},
+		{"http://example.com/a#noquote http://example.com/b", 1},
+	}
+	for _, test := range tests {
+		claimers.list = nil
+		var posted []string
+		for _, name := range []string{"first", "second"} {
+			name := name
+			AddClaimer(func(conn *irc.Conn, line irc.Line, dst string, url *url.URL, claim *Claim) {
+				if claim.Take(name) {
+					posted = append(posted, name+" "+url.String())
+				}
+			})
+		}
+		dispatchURLs(nil, irc.Line{}, "#chan", test.text, false)
+		if len(posted) != test.previews {
+			t.Errorf("%q: got previews %q, want %d", test.text, posted, test.previews)
+		}
+		for _, p := range posted {
+			if p[:len("first ")] != "first " {
+				t.Errorf("%q: preview %q was posted by a later claimer", test.text, p)
+			}
+		}
+	}
+}
+
+// Redirects are dispatched from the goroutines of the plugins that follow
+// them, so claimers can run concurrently.
+func TestConcurrentRedirects(t *testing.T) {
+	defer teardown()
+	claimers.list = nil
+
+	var mu sync.Mutex
+	previews := 0
+	AddClaimer(func(conn *irc.Conn, line irc.Line, dst string, url *url.URL, claim *Claim) {
+		if claim.Take("test") {
+			mu.Lock()
+			previews++
+			mu.Unlock()
+		}
+	})
+	msg := &message{}
+	claim := &Claim{msg: msg, url: &url.URL{Scheme: "http", Host: "short.example"}}
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			claim.Redirect(nil, irc.Line{}, "#chan", &url.URL{Scheme: "http", Host: "example.com"})
+		}()
+	}
+	wg.Wait()
+	if previews != config.MaxPreviews {
+		t.Errorf("got %d previews, want %d", previews, config.MaxPreviews)
+	}
+}
+
+func TestExtractURLs(t *testing.T) {
+	tests := []struct {
+		text string
+		urls []string
+	}{
+		{"no links here", nil},
+		{"see http://example.com/foo.", []string{"http://example.com/foo"}},
+		{"(http://example.com/foo_(bar))", []string{"http://example.com/foo_(bar)"}},
+		{"http://a.com/ and http://a.com/ again", []string{"http://a.com/"}},
+		{"www.example.com/foo", nil},
+	}
+	for _, test := range tests {
+		var got []string
+		for _, u := range ExtractURLs(test.text) {
+			got = append(got, u.String())
+		}
+		if len(got) != len(test.urls) {
+			t.Errorf("ExtractURLs(%q) = %q, want %q", test.text, got, test.urls)
+			continue
+		}
+		for i := range got {
+			if got[i] != test.urls[i] {
+				t.Errorf("ExtractURLs(%q) = %q, want %q", test.text, got, test.urls)
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,214 @@
+package urls
+
+import (
+	"../database"
+	"bufio"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// A Record is a row of URL history as exported and imported.
+type Record struct {
+	URL       string    `json:"url"`
+	Canonical string    `json:"canonical"`
+	Nick      string    `json:"nick"`
+	Src       string    `json:"src"`
+	Channel   string    `json:"channel"`
+	Timestamp time.Time `json:"timestamp"`
+	Title     string    `json:"title,omitempty"`
+}
+
+var csvHeader = []string{"url", "canonical", "nick", "src", "channel", "timestamp", "title"}
+
+// Export formats
+const (
+	FormatJSON = "jsonl"
+	FormatCSV  = "csv"
+)
+
+// A Filter selects the history to export. Zero fields match everything.
+type Filter struct {
+	Channel string
+	Since   time.Time
+	Until   time.Time
+}
+
+// Export writes the history matching filter to w, oldest first, as JSON Lines
+// or CSV. It returns the number of records written.
+func Export(db *sql.DB, w io.Writer, format string, filter Filter) (int, error) {
+	if format != FormatJSON && format != FormatCSV {
+		return 0, fmt.Errorf("unknown format %q", format)
+	}
+	q := &query{}
+	if filter.Channel != "" {
+		q.add("LOWER(s.dst) = LOWER(?)", filter.Channel)
+	}
+	if !filter.Since.IsZero() {
+		q.add("s.timestamp >= ?", filter.Since)
+	}
+	if !filter.Until.IsZero() {
+		q.add("s.timestamp < ?", filter.Until)
+	}
+	sqlstr := "SELECT s.url, s.canonical, s.nick, s.src, s.dst, s.timestamp, f.title FROM seen s LEFT JOIN seen_fts f ON f.docid = s.id"
+	if len(q.where) > 0 {
+		sqlstr += " WHERE " + strings.Join(q.where, " AND ")
+	}
+	sqlstr += " ORDER BY s.id"
+	rows, err := db.Query(sqlstr, q.args...)
+	if err != nil {
+		return 0, fmt.Errorf("%q: %s", err, sqlstr)
+	}
+	defer rows.Close()
+
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+	cw := csv.NewWriter(bw)
+	if format == FormatCSV {
+		cw.Write(csvHeader)
+	}
+	count := 0
+	for rows.Next() {
+		var rec Record
+		var canonical, nick, title sql.NullString
+		if err := rows.Scan(&rec.URL, &canonical, &nick, &rec.Src, &rec.Channel, &rec.Timestamp, &title); err != nil {
+			return count, err
+		}
+		rec.Canonical, rec.Nick, rec.Title = canonical.String, nick.String, title.String
+		if format == FormatJSON {
+			err = enc.Encode(rec)
+		} else {
+			err = cw.Write([]string{rec.URL, rec.Canonical, rec.Nick, rec.Src, rec.Channel, rec.Timestamp.Format(time.RFC3339Nano), rec.Title})
+		}
+		if err != nil {
+			return count, err
+		}
+		count++
+	}
+	if err := rows.Err(); err != nil {
+		return count, err
+	}
+	cw.Flush()
+	if err := cw.Error(); err != nil {
+		return count, err
+	}
+	return count, bw.Flush()
+}
+
+// Import reads JSON Lines or CSV produced by Export and adds the records to
+// the history. Records that are already present, i.e. the same URL posted by
+// the same nick to the same channel at the same time, are skipped, as are
+// records from excluded channels. Hostmasks are stored according to the
+// hostmasks setting, and the canonical form of each URL is recomputed.
+// Everything is imported in one transaction, so nothing is imported if
+// there's an error.
+func Import(db *sql.DB, r io.Reader, format string) (imported, duplicates, excludedCount int, err error) {
+	var next func() (*Record, error)
+	switch format {
+	case FormatJSON:
+		dec := json.NewDecoder(r)
+		next = func() (*Record, error) {
+			var rec Record
+			if err := dec.Decode(&rec); err != nil {
+				return nil, err
+			}
+			return &rec, nil
+		}
+	case FormatCSV:
+		cr := csv.NewReader(r)
+		cr.FieldsPerRecord = len(csvHeader)
+		header, err := cr.Read()
+		if err != nil {
+			return 0, 0, 0, err
+		} else if strings.Join(header, ",") != strings.Join(csvHeader, ",") {
+			return 0, 0, 0, fmt.Errorf("unexpected CSV header %q", strings.Join(header, ","))
+		}
+		next = func() (*Record, error) {
+			fields, err := cr.Read()
+			if err != nil {
+				return nil, err
+			}
+			rec := &Record{URL: fields[0], Canonical: fields[1], Nick: fields[2], Src: fields[3], Channel: fields[4], Title: fields[6]}
+			if rec.Timestamp, err = time.Parse(time.RFC3339Nano, fields[5]); err != nil {
+				return nil, err
+			}
+			return rec, nil
+		}
+	default:
+		return 0, 0, 0, fmt.Errorf("unknown format %q", format)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+			imported, duplicates, excludedCount = 0, 0, 0
+		} else {
+			err = tx.Commit()
+		}
+	}()
+
+	for n := 1; ; n++ {
+		var rec *Record
+		if rec, err = next(); err == io.EOF {
+			err = nil
+			return
+		} else if err != nil {
+			err = fmt.Errorf("record %d: %v", n, err)
+			return
+		}
+		if excluded(rec.Channel) {
+			excludedCount++
+			continue
+		}
+		var added bool
+		if added, err = importRecord(tx, rec); err != nil {
+			err = fmt.Errorf("record %d: %v", n, err)
+			return
+		}
+		if added {
+			imported++
+		} else {
+			duplicates++
+		}
+	}
+}
+
+func importRecord(tx *sql.Tx, rec *Record) (bool, error) {
+	u, err := url.Parse(rec.URL)
+	if err != nil {
+		return false, err
+	}
+	if rec.Channel == "" || rec.Timestamp.IsZero() {
+		return false, fmt.Errorf("missing channel or timestamp")
+	}
+	// timestamps are stored in local time, and compared as strings
+	timestamp := rec.Timestamp.Local()
+
+	var count int
+	sqlstr := "SELECT COUNT(*) FROM seen WHERE url = ? AND dst = ? AND nick = ? AND timestamp = ?"
+	if err := tx.QueryRow(sqlstr, rec.URL, rec.Channel, rec.Nick, timestamp).Scan(&count); err != nil {
+		return false, err
+	} else if count > 0 {
+		return false, nil
+	}
+
+	sqlstr = "INSERT INTO seen (url, canonical, nick, src, dst, timestamp) VALUES (?, ?, ?, ?, ?, ?)"
+	id, err := database.Insert(tx, sqlstr, rec.URL, Canonicalize(u), rec.Nick, storedSource(rec.Src), rec.Channel, timestamp)
+	if err != nil {
+		return false, err
+	}
+	sqlstr = "INSERT INTO seen_fts (docid, url, title) VALUES (?, ?, ?)"
+	if _, err := tx.Exec(sqlstr, id, rec.URL, rec.Title); err != nil {
+		return false, err
+	}
+	return true, nil
+}
@@ -0,0 +1,106 @@
+package urls
+
+import (
+	"net"
+	"net/url"
+	"strings"
+)
+
+// Canonicalize returns the form of the URL used to match it against history,
+// so that trivially different links to the same page are counted together.
+// The scheme, host and port are normalized, tracking parameters, fragments and
+// trailing slashes are removed, and known short-link and mobile hosts are
+// expanded to their main site. The result is only used for comparison, it
+// isn't necessarily a working URL.
+func Canonicalize(u *url.URL) string {
+	c := *u
+	c.Scheme = strings.ToLower(c.Scheme)
+	if c.Scheme == "http" {
+		c.Scheme = "https"
+	}
+	c.User = nil
+	c.Fragment = ""
+
+	host := strings.ToLower(c.Host)
+	if h, port, err := net.SplitHostPort(host); err == nil && (port == "80" || port == "443") {
+		host = h
+	}
+	host = strings.TrimSuffix(host, ".")
+	host = strings.TrimPrefix(host, "www.")
+	if alias, ok := hostAliases[host]; ok {
+		host = alias
+	}
+	c.Host = host
+
+	query := c.Query()
+	if expand, ok := shortLinks[host]; ok {
+		host, c.Path = expand(c.Path, query)
+		c.Host = host
+	}
+	for key := range query {
+		if isTrackingParam(host, key) {
+			delete(query, key)
+		}
+	}
+	// Encode sorts the parameters by key
+	c.RawQuery = query.Encode()
+
+	// keep the path escaped, as /a%2Fb and /a/b are different pages
+	c.RawPath = strings.TrimRight(c.EscapedPath(), "/")
+	if path, err := url.PathUnescape(c.RawPath); err == nil {
+		c.Path = path
+	} else {
+		c.Path = strings.TrimRight(c.Path, "/")
+	}
+	return c.String()
+}
+
+// hostAliases maps mobile and alternate hosts to the main site.
+var hostAliases = map[string]string{
+	"m.youtube.com":        "youtube.com",
+	"youtube-nocookie.com": "youtube.com",
+	"mobile.twitter.com":   "twitter.com",
+	"m.facebook.com":       "facebook.com",
+	"en.m.wikipedia.org":   "en.wikipedia.org",
+	"m.imgur.com":          "imgur.com",
+	"old.reddit.com":       "reddit.com",
+	"m.reddit.com":         "reddit.com",
+}
+
+// shortLinks expands the path of a short link into the host and path of the
+// page it refers to. Query parameters may be added to query.
+var shortLinks = map[string]func(path string, query url.Values) (string, string){
+	"youtu.be": func(path string, query url.Values) (string, string) {
+		if id := strings.Trim(path, "/"); id != "" {
+			query.Set("v", id)
+			return "youtube.com", "/watch"
+		}
+		return "youtube.com", path
+	},
+	"redd.it": func(path string, query url.Values) (string, string) {
+		return "reddit.com", "/comments" + path
+	},
+}
+
+// trackingParams lists query parameters that don't affect the page, by host.
+// Parameters for the empty host apply everywhere.
+var trackingParams = map[string][]string{
+	"":            {"fbclid", "gclid", "dclid", "msclkid", "mc_cid", "mc_eid", "igshid", "ref_src", "ref_url"},
+	"youtube.com": {"feature", "si", "ab_channel"},
+	"twitter.com": {"s", "t", "ref_src"},
+}
+
+func isTrackingParam(host, key string) bool {
+	key = strings.ToLower(key)
+	if strings.HasPrefix(key, "utm_") {
+		return true
+	}
+	for _, h := range []string{"", host} {
+		for _, param := range trackingParams[h] {
+			if key == param {
+				return true
+			}
+		}
+	}
+	return false
+}
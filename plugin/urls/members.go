@@ -0,0 +1,108 @@
+package urls
+
+import (
+	"github.com/kballard/goirc/irc"
+	"strings"
+	"sync"
+)
+
+// members tracks which nicks are in each of the bot's channels, so history
+// queries made in private can be limited to the channels the user is in.
+var members struct {
+	sync.Mutex
+	channels map[string]map[string]bool // lowercased channel -> lowercased nicks
+}
+
+func trackMembers(reg irc.HandlerRegistry) {
+	resetMembers()
+	reg.AddHandler("353", func(conn *irc.Conn, line irc.Line) {
+		// RPL_NAMREPLY: me = #channel :nick @nick +nick
+		if len(line.Args) < 4 {
+			return
+		}
+		for _, nick := range strings.Fields(line.Args[3]) {
+			addMember(line.Args[2], strings.TrimLeft(nick, "~&@%+"))
+		}
+	})
+	reg.AddHandler("JOIN", func(conn *irc.Conn, line irc.Line) {
+		if len(line.Args) > 0 {
+			addMember(line.Args[0], line.Src.Nick)
+		}
+	})
+	reg.AddHandler("PART", func(conn *irc.Conn, line irc.Line) {
+		if len(line.Args) > 0 {
+			removeMember(line.Args[0], line.Src.Nick, line.SrcIsMe())
+		}
+	})
+	reg.AddHandler("KICK", func(conn *irc.Conn, line irc.Line) {
+		if len(line.Args) > 1 {
+			removeMember(line.Args[0], line.Args[1], line.Args[1] == conn.Me().Nick)
+		}
+	})
+	reg.AddHandler("QUIT", func(conn *irc.Conn, line irc.Line) {
+		members.Lock()
+		defer members.Unlock()
+		nick := strings.ToLower(line.Src.Nick)
+		for _, nicks := range members.channels {
+			delete(nicks, nick)
+		}
+	})
+	reg.AddHandler("NICK", func(conn *irc.Conn, line irc.Line) {
+		if len(line.Args) == 0 {
+			return
+		}
+		members.Lock()
+		defer members.Unlock()
+		old, nick := strings.ToLower(line.Src.Nick), strings.ToLower(line.Args[0])
+		for _, nicks := range members.channels {
+			if nicks[old] {
+				delete(nicks, old)
+				nicks[nick] = true
+			}
+		}
+	})
+}
+
+func resetMembers() {
+	members.Lock()
+	defer members.Unlock()
+	members.channels = make(map[string]map[string]bool)
+}
+
+func addMember(channel, nick string) {
+	members.Lock()
+	defer members.Unlock()
+	channel = strings.ToLower(channel)
+	nicks := members.channels[channel]
+	if nicks == nil {
+		nicks = make(map[string]bool)
+		members.channels[channel] = nicks
+	}
+	nicks[strings.ToLower(nick)] = true
+}
+
+// removeMember forgets the whole channel if the bot itself left.
+func removeMember(channel, nick string, isMe bool) {
+	members.Lock()
+	defer members.Unlock()
+	channel = strings.ToLower(channel)
+	if isMe {
+		delete(members.channels, channel)
+	} else if nicks := members.channels[channel]; nicks != nil {
+		delete(nicks, strings.ToLower(nick))
+	}
+}
+
+// channelsOf returns the (lowercased) channels that nick shares with the bot.
+func channelsOf(nick string) []string {
+	members.Lock()
+	defer members.Unlock()
+	nick = strings.ToLower(nick)
+	var channels []string
+	for channel, nicks := range members.channels {
+		if nicks[nick] {
+			channels = append(channels, channel)
+		}
+	}
+	return channels
+}
@@ -0,0 +1,156 @@
+package urls
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// Hostmask storage modes
+const (
+	HostmaskKeep = "keep"
+	HostmaskHash = "hash"
+	HostmaskOmit = "omit"
+)
+
+// errNoSources is returned by forget when hostmasks aren't recorded.
+var errNoSources = errors.New("hostmasks aren't recorded")
+
+// how often old history is pruned
+const pruneInterval = time.Hour
+
+// storedSource returns the form of the hostmask nick!user@host that is
+// recorded in history.
+func storedSource(raw string) string {
+	switch config.Hostmasks {
+	case HostmaskOmit:
+		return ""
+	case HostmaskHash:
+		if raw == "" || strings.HasPrefix(raw, "sha256:") {
+			return raw
+		}
+		// the nick is recorded separately
+		if i := strings.Index(raw, "!"); i >= 0 {
+			raw = raw[i+1:]
+		}
+		sum := sha256.Sum256([]byte(strings.ToLower(raw)))
+		return "sha256:" + hex.EncodeToString(sum[:8])
+	}
+	return raw
+}
+
+// rewriteSources brings hostmasks recorded under a previous hostmasks setting
+// in line with the current one.
+func rewriteSources(db *sql.DB) error {
+	switch config.Hostmasks {
+	case HostmaskOmit:
+		_, err := db.Exec("UPDATE seen SET src = '' WHERE src != ''")
+		return err
+	case HostmaskHash:
+		rows, err := db.Query("SELECT DISTINCT src FROM seen WHERE src LIKE '%!%'")
+		if err != nil {
+			return err
+		}
+		var srcs []string
+		for rows.Next() {
+			var src string
+			if err := rows.Scan(&src); err != nil {
+				rows.Close()
+				return err
+			}
+			srcs = append(srcs, src)
+		}
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		for _, src := range srcs {
+			if _, err := db.Exec("UPDATE seen SET src = ? WHERE src = ?", storedSource(src), src); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// excluded returns whether URLs posted to dst should not be recorded.
+func excluded(dst string) bool {
+	for _, channel := range config.ExcludeChannels {
+		if strings.EqualFold(channel, dst) {
+			return true
+		}
+	}
+	return false
+}
+
+// prune deletes history older than the retention period.
+func prune(db *sql.DB) error {
+	if config.RetentionDays <= 0 {
+		return nil
+	}
+	cutoff := time.Now().AddDate(0, 0, -config.RetentionDays)
+	return deleteWhere(db, "timestamp < ?", cutoff)
+}
+
+func pruneLoop(db *sql.DB, stop <-chan struct{}) {
+	ticker := time.NewTicker(pruneInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := prune(db); err != nil {
+				fmt.Fprintln(os.Stderr, "urls: prune:", err)
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+// forget deletes the URLs posted from the hostmask raw, or only those
+// matching canonical if it isn't empty. It returns the number of entries
+// deleted. Posts are matched by their recorded source rather than the nick,
+// which anyone could take, so nothing can be forgotten if hostmasks are
+// omitted.
+func forget(db *sql.DB, raw, canonical string) (int64, error) {
+	src := storedSource(raw)
+	if src == "" {
+		return 0, errNoSources
+	}
+	cond, args := "src = ?", []interface{}{src}
+	if canonical != "" {
+		cond += " AND canonical = ?"
+		args = append(args, canonical)
+	}
+	var count int64
+	if err := db.QueryRow("SELECT COUNT(*) FROM seen WHERE "+cond, args...).Scan(&count); err != nil {
+		return 0, err
+	}
+	if count == 0 {
+		return 0, nil
+	}
+	return count, deleteWhere(db, cond, args...)
+}
+
+// deleteWhere deletes matching history along with its search index entries.
+func deleteWhere(db *sql.DB, cond string, args ...interface{}) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	sqls := []string{
+		"DELETE FROM seen_fts WHERE docid IN (SELECT id FROM seen WHERE " + cond + ")",
+		"DELETE FROM seen WHERE " + cond,
+	}
+	for _, sqlstr := range sqls {
+		if _, err := tx.Exec(sqlstr, args...); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("%q: %s", err, sqlstr)
+		}
+	}
+	return tx.Commit()
+}
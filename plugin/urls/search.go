@@ -0,0 +1,172 @@
+package urls
+
+import (
+	"../database"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// number of results shown per page
+const pageSize = 5
+
+// A query is a history search, kept so that !urls more can show the next
+// page of results.
+type query struct {
+	where  []string
+	args   []interface{}
+	offset int
+}
+
+// the last query made by each nick
+var queries struct {
+	sync.Mutex
+	byNick map[string]*query
+}
+
+func init() {
+	queries.byNick = make(map[string]*query)
+}
+
+// parseQuery builds a query from search terms and filters of the form
+// nick:name, chan:#channel, host:example.com, since:2006-01-02 and
+// until:2006-01-02.
+func parseQuery(words []string) (*query, error) {
+	q := &query{}
+	var terms []string
+	for _, word := range words {
+		key, value := "", word
+		if i := strings.Index(word, ":"); i > 0 {
+			key, value = strings.ToLower(word[:i]), word[i+1:]
+		}
+		switch key {
+		case "nick":
+			q.add("LOWER(s.nick) = LOWER(?)", value)
+		case "chan", "channel":
+			q.add("LOWER(s.dst) = LOWER(?)", value)
+		case "host":
+			host := strings.TrimPrefix(strings.ToLower(value), "www.")
+			q.add("(s.canonical = ? OR s.canonical LIKE ? OR s.canonical LIKE ? OR s.canonical LIKE ? OR s.canonical LIKE ?)",
+				"https://"+host, "https://"+host+"/%", "https://"+host+"?%", "https://%."+host, "https://%."+host+"/%")
+		case "since", "until":
+			date, err := time.ParseInLocation("2006-01-02", value, time.Local)
+			if err != nil {
+				return nil, fmt.Errorf("invalid date %q, expected YYYY-MM-DD", value)
+			}
+			if key == "since" {
+				q.add("s.timestamp >= ?", date)
+			} else {
+				q.add("s.timestamp < ?", date.AddDate(0, 0, 1))
+			}
+		default:
+			terms = append(terms, searchTerms(word)...)
+		}
+	}
+	if len(terms) > 0 {
+		if database.Driver() == "postgres" {
+			q.add("s.id IN (SELECT docid FROM seen_fts WHERE "+pgSearchVector+" @@ to_tsquery('simple', ?))", strings.Join(terms, " & "))
+		} else {
+			q.add("s.id IN (SELECT docid FROM seen_fts WHERE seen_fts MATCH ?)", strings.Join(terms, " "))
+		}
+	} else if len(words) > 0 && len(q.where) == 0 {
+		return nil, errors.New("nothing to search for")
+	}
+	return q, nil
+}
+
+// the tsvector that postgres searches, splitting URLs into words much like
+// the fts4 tokenizer
+const pgSearchVector = `to_tsvector('simple', regexp_replace(url || ' ' || title, '[^[:alnum:]]+', ' ', 'g'))`
+
+// searchTerms turns a word of a search into terms of the full-text query
+// syntax of the database. Each term is quoted so query syntax can't cause
+// errors. A trailing * matches any word with the prefix.
+func searchTerms(word string) []string {
+	prefix := strings.HasSuffix(word, "*")
+	word = strings.TrimRight(word, "*")
+	if database.Driver() != "postgres" {
+		term := strings.Replace(word, `"`, "", -1)
+		if term == "" {
+			return nil
+		} else if prefix {
+			return []string{`"` + term + `*"`}
+		}
+		return []string{`"` + term + `"`}
+	}
+	// postgres needs the word split the way the tsvector is
+	var terms []string
+	for _, part := range strings.FieldsFunc(word, func(r rune) bool { return !unicode.IsLetter(r) && !unicode.IsDigit(r) }) {
+		terms = append(terms, "'"+strings.ToLower(part)+"'")
+	}
+	if prefix && len(terms) > 0 {
+		terms[len(terms)-1] += ":*"
+	}
+	return terms
+}
+
+func (q *query) add(cond string, args ...interface{}) {
+	q.where = append(q.where, cond)
+	q.args = append(q.args, args...)
+}
+
+// scope restricts the query to the given channels.
+func (q *query) scope(channels []string) {
+	placeholders := make([]string, len(channels))
+	args := make([]interface{}, len(channels))
+	for i, channel := range channels {
+		placeholders[i] = "?"
+		args[i] = strings.ToLower(channel)
+	}
+	q.add("LOWER(s.dst) IN ("+strings.Join(placeholders, ", ")+")", args...)
+}
+
+type result struct {
+	nick, dst, url, title string
+	timestamp             time.Time
+}
+
+// next returns the next page of results. The most recent post of each
+// distinct URL is returned.
+func (q *query) next(db *sql.DB) ([]result, bool, error) {
+	latest := "SELECT MAX(s.id) FROM seen s"
+	if len(q.where) > 0 {
+		latest += " WHERE " + strings.Join(q.where, " AND ")
+	}
+	latest += " GROUP BY s.canonical"
+	sqlstr := "SELECT s.id, s.nick, s.src, s.timestamp, s.dst, s.url, f.title FROM seen s LEFT JOIN seen_fts f ON f.docid = s.id WHERE s.id IN (" + latest + ") ORDER BY s.id DESC LIMIT ? OFFSET ?"
+	args := append(append([]interface{}{}, q.args...), pageSize+1, q.offset)
+	rows, err := db.Query(sqlstr, args...)
+	if err != nil {
+		return nil, false, err
+	}
+	defer rows.Close()
+
+	var results []result
+	for rows.Next() {
+		var id int64
+		var r result
+		var nick, title sql.NullString
+		var src string
+		if err := rows.Scan(&id, &nick, &src, &r.timestamp, &r.dst, &r.url, &title); err != nil {
+			return nil, false, err
+		}
+		r.nick, r.title = nick.String, title.String
+		if r.nick == "" {
+			r.nick = src
+		}
+		results = append(results, r)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, false, err
+	}
+	more := len(results) > pageSize
+	if more {
+		results = results[:pageSize]
+	}
+	q.offset += len(results)
+	return results, more, nil
+}
@@ -0,0 +1,149 @@
+package urls
+
+import (
+	"database/sql"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// number of entries in each leaderboard
+const statsSize = 5
+
+// stats returns lines summarizing the history matched by q.
+func stats(db *sql.DB, q *query) ([]string, error) {
+	where := "1 = 1"
+	if len(q.where) > 0 {
+		where = strings.Join(q.where, " AND ")
+	}
+
+	var lines []string
+	leaderboards := []struct {
+		title, sqlstr string
+	}{
+		{"Top posters", "SELECT MIN(s.nick), COUNT(*) AS n FROM seen s WHERE " + where + " GROUP BY LOWER(s.nick) ORDER BY n DESC LIMIT ?"},
+		{"Most reposted", "SELECT MAX(s.url), COUNT(*) AS n FROM seen s WHERE " + where + " GROUP BY s.canonical, s.dst HAVING COUNT(*) > 1 ORDER BY n DESC LIMIT ?"},
+		{"Top reposters", "SELECT MIN(s.nick), COUNT(*) AS n FROM seen s WHERE " + where + " AND " + repostCond + " GROUP BY LOWER(s.nick) ORDER BY n DESC LIMIT ?"},
+	}
+	for _, board := range leaderboards {
+		entries, err := leaderboard(db, board.sqlstr, append(append([]interface{}{}, q.args...), statsSize)...)
+		if err != nil {
+			return nil, err
+		}
+		if len(entries) > 0 {
+			lines = append(lines, board.title+": "+strings.Join(entries, ", "))
+		}
+	}
+
+	domains, err := topDomains(db, where, q.args)
+	if err != nil {
+		return nil, err
+	}
+	if len(domains) > 0 {
+		lines = append(lines, "Top domains: "+strings.Join(domains, ", "))
+	}
+
+	activity, err := channelActivity(db, where, q.args)
+	if err != nil {
+		return nil, err
+	}
+	return append(lines, activity...), nil
+}
+
+// repostCond matches posts of a URL that was already posted to the channel.
+const repostCond = "EXISTS (SELECT 1 FROM seen p WHERE p.canonical = s.canonical AND p.dst = s.dst AND p.id < s.id)"
+
+// reposts returns the number of times nick has reposted a URL in dst.
+func reposts(tx *sql.Tx, nick, dst string) (int64, error) {
+	var count int64
+	sqlstr := "SELECT COUNT(*) FROM seen s WHERE LOWER(s.nick) = LOWER(?) AND s.dst = ? AND " + repostCond
+	err := tx.QueryRow(sqlstr, nick, dst).Scan(&count)
+	return count, err
+}
+
+// leaderboard runs a query returning (name, count) rows.
+func leaderboard(db *sql.DB, sqlstr string, args ...interface{}) ([]string, error) {
+	rows, err := db.Query(sqlstr, args...)
+	if err != nil {
+		return nil, fmt.Errorf("%q: %s", err, sqlstr)
+	}
+	defer rows.Close()
+	var entries []string
+	for rows.Next() {
+		var name sql.NullString
+		var count int64
+		if err := rows.Scan(&name, &count); err != nil {
+			return nil, err
+		}
+		entries = append(entries, fmt.Sprintf("%s (%d)", name.String, count))
+	}
+	return entries, rows.Err()
+}
+
+func topDomains(db *sql.DB, where string, args []interface{}) ([]string, error) {
+	sqlstr := "SELECT s.canonical, COUNT(*) FROM seen s WHERE " + where + " GROUP BY s.canonical"
+	rows, err := db.Query(sqlstr, args...)
+	if err != nil {
+		return nil, fmt.Errorf("%q: %s", err, sqlstr)
+	}
+	defer rows.Close()
+	counts := make(map[string]int64)
+	for rows.Next() {
+		var canonical sql.NullString
+		var count int64
+		if err := rows.Scan(&canonical, &count); err != nil {
+			return nil, err
+		}
+		if u, err := url.Parse(canonical.String); err == nil && u.Host != "" {
+			counts[u.Host] += count
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	hosts := make([]string, 0, len(counts))
+	for host := range counts {
+		hosts = append(hosts, host)
+	}
+	sort.Slice(hosts, func(i, j int) bool {
+		if counts[hosts[i]] != counts[hosts[j]] {
+			return counts[hosts[i]] > counts[hosts[j]]
+		}
+		return hosts[i] < hosts[j]
+	})
+	if len(hosts) > statsSize {
+		hosts = hosts[:statsSize]
+	}
+	entries := make([]string, len(hosts))
+	for i, host := range hosts {
+		entries[i] = fmt.Sprintf("%s (%d)", host, counts[host])
+	}
+	return entries, nil
+}
+
+// channelActivity returns a line for each channel counting the URLs posted
+// in the last day, week and month.
+func channelActivity(db *sql.DB, where string, args []interface{}) ([]string, error) {
+	now := time.Now()
+	sqlstr := "SELECT MIN(s.dst), SUM(CASE WHEN s.timestamp >= ? THEN 1 ELSE 0 END), SUM(CASE WHEN s.timestamp >= ? THEN 1 ELSE 0 END), COUNT(*) FROM seen s WHERE " + where + " AND s.timestamp >= ? GROUP BY LOWER(s.dst) ORDER BY COUNT(*) DESC"
+	args = append([]interface{}{now.AddDate(0, 0, -1), now.AddDate(0, 0, -7)}, args...)
+	args = append(args, now.AddDate(0, -1, 0))
+	rows, err := db.Query(sqlstr, args...)
+	if err != nil {
+		return nil, fmt.Errorf("%q: %s", err, sqlstr)
+	}
+	defer rows.Close()
+	var lines []string
+	for rows.Next() {
+		var dst string
+		var day, week, month int64
+		if err := rows.Scan(&dst, &day, &week, &month); err != nil {
+			return nil, err
+		}
+		lines = append(lines, fmt.Sprintf("%s: %d in the last day, %d in the last week, %d in the last month", dst, day, week, month))
+	}
+	return lines, rows.Err()
+}
@@ -4,59 +4,114 @@ import (
 	"../"
 	"../command"
 	"../database"
+	"../title"
+	"../urlevent"
 	"database/sql"
+	"errors"
 	"fmt"
 	"github.com/kballard/gocallback/callback"
 	"github.com/kballard/goirc/irc"
 	"net/url"
 	"os"
-	"regexp"
 	"strings"
 	"time"
 )
 
-var URLRegex = regexp.MustCompile("(?i)\\b((?:[a-z][\\w-]+:(?:/{1,3}|[a-z0-9%])|www\\d{0,3}[.]|[a-z0-9.\\-]+[.][a-z]{2,4}/)(?:[^\\s()<>]+|\\(([^\\s()<>]+|(\\([^\\s()<>]+\\)))*\\))+(?:\\(([^\\s()<>]+|(\\([^\\s()<>]+\\)))*\\)|[^\\s`!()\\[\\]{};:'\".,<>?«»“”‘’]))")
-
 var historyDB *sql.DB
+var historyWriter *database.Writer
+var stopPruning chan struct{}
+
+var config = urlsConfig{
+	FetchTitles:   true,
+	Hostmasks:     HostmaskKeep,
+	BatchSize:     50,
+	FlushInterval: time.Second,
+}
+
+type urlsConfig struct {
+	// Fetch the title of each page so it can be searched
+	FetchTitles bool `yaml:"fetch_titles"`
+	// URLs older than this many days are deleted, or never if 0
+	RetentionDays int `yaml:"retention_days"`
+	// Channels where URLs aren't recorded
+	ExcludeChannels []string `yaml:"exclude_channels"`
+	// How to record the user@host of whoever posted a URL: keep, hash or
+	// omit. Hashing or omitting rewrites the existing history, and can't be
+	// undone.
+	Hostmasks string `yaml:"hostmasks"`
+	// Include the poster's repost count when announcing a repost
+	RepostShame bool `yaml:"repost_shame"`
+	// URLs are recorded in batches of up to this many, at least every
+	// flush_interval
+	BatchSize     int           `yaml:"batch_size"`
+	FlushInterval time.Duration `yaml:"flush_interval"`
+}
+
+func (c *urlsConfig) Validate() error {
+	if c.RetentionDays < 0 {
+		return errors.New("retention_days must not be negative")
+	} else if c.BatchSize <= 0 {
+		return errors.New("batch_size must be positive")
+	} else if c.FlushInterval <= 0 {
+		return errors.New("flush_interval must be positive")
+	}
+	switch c.Hostmasks {
+	case HostmaskKeep, HostmaskHash, HostmaskOmit:
+	default:
+		return fmt.Errorf("hostmasks must be %s, %s or %s", HostmaskKeep, HostmaskHash, HostmaskOmit)
+	}
+	return nil
+}
 
 func init() {
-	plugin.RegisterPlugin("urls", plugin.Callbacks{Init: setupURLs, Teardown: teardownURLs})
+	database.RegisterMigrations("history.db", "urls",
+		database.Migration{Version: 1, Description: "create seen table", SQL: []string{
+			"CREATE TABLE IF NOT EXISTS seen (id integer not null primary key, url text not null, nick text, src text not null, dst text not null, timestamp datetime not null)",
+			"CREATE INDEX IF NOT EXISTS url_idx ON seen (url, dst)",
+		}, DriverSQL: map[string][]string{"postgres": {
+			"CREATE TABLE IF NOT EXISTS seen (id bigserial not null primary key, url text not null, nick text, src text not null, dst text not null, timestamp timestamptz not null)",
+			"CREATE INDEX IF NOT EXISTS url_idx ON seen (url, dst)",
+		}}},
+		database.Migration{Version: 2, Description: "add canonical URLs", Func: addCanonicalColumn},
+		database.Migration{Version: 3, Description: "index canonical URLs", SQL: []string{
+			"CREATE INDEX IF NOT EXISTS canonical_idx ON seen (canonical, dst)",
+		}},
+		database.Migration{Version: 4, Description: "add full-text search index", Func: createSearchIndex},
+	)
+	plugin.RegisterPlugin("urls", plugin.Callbacks{Init: setupURLs, Teardown: teardownURLs, NewConnection: trackMembers, Disconnected: resetMembers, Config: &config, Requires: []string{"URL", "COMMAND"}})
+}
+
+// OpenHistory opens history.db from the configured database backend,
+// creating or upgrading its tables as needed. The database must be closed
+// with database.Close.
+func OpenHistory() (*sql.DB, error) {
+	return database.OpenNamed("history.db")
 }
 
-func setupURLs(reg *callback.Registry, config map[string]interface{}) error {
+func setupURLs(reg *callback.Registry, _ map[string]interface{}) error {
 	var err error
-	historyDB, err = database.Open("sqlite3", "./history.db")
+	historyDB, err = OpenHistory()
 	if err != nil {
 		return err
 	}
-
-	sqls := []string{
-		"CREATE TABLE IF NOT EXISTS seen (id integer not null primary key, url text not null, nick text, src text not null, dst text not null, timestamp datetime not null)",
-		"CREATE INDEX IF NOT EXISTS url_idx ON seen (url, dst)",
+	if err = rewriteSources(historyDB); err != nil {
+		return err
 	}
-	for _, sqlstr := range sqls {
-		_, err = historyDB.Exec(sqlstr)
-		if err != nil {
-			return err
-		}
+	if err = prune(historyDB); err != nil {
+		return err
 	}
+	stopPruning = make(chan struct{})
+	go pruneLoop(historyDB, stopPruning)
+	historyWriter = database.NewWriter("urls", historyDB, config.BatchSize, config.FlushInterval)
 
-	reg.AddCallback("PRIVMSG", func(conn *irc.Conn, line irc.Line, dst, text string) {
-		matches := URLRegex.FindAllStringSubmatch(text, -1)
-		if matches != nil {
-			for _, submatches := range matches {
-				urlStr := submatches[1]
-				if u, err := url.Parse(urlStr); err == nil && u.Host != "" {
-					reg.Dispatch("URL", conn, line, dst, u)
-				}
-			}
+	reg.AddCallback("URL", func(conn *irc.Conn, line irc.Line, dst string, url *url.URL, claim *urlevent.Claim) {
+		// private messages aren't recorded, nor are the destinations of
+		// redirects or corrected URLs as the user didn't post them
+		if dst != conn.Me().Nick && !excluded(dst) && claim.Via() == nil && !claim.Corrected() {
+			handleURL(conn, historyWriter, line, dst, url)
 		}
 	})
 
-	reg.AddCallback("URL", func(conn *irc.Conn, line irc.Line, dst string, url *url.URL) {
-		handleURL(conn, historyDB, line, dst, url)
-	})
-
 	reg.AddCallback("COMMAND", func(conn *irc.Conn, line irc.Line, cmd, arg, dst string, isPrivate bool) {
 		if cmd == "urls" {
 			handleCommand(conn, historyDB, line, arg, dst, isPrivate)
@@ -67,6 +122,14 @@ func setupURLs(reg *callback.Registry, config map[string]interface{}) error {
 }
 
 func teardownURLs() error {
+	if historyWriter != nil {
+		historyWriter.Close()
+		historyWriter = nil
+	}
+	if stopPruning != nil {
+		close(stopPruning)
+		stopPruning = nil
+	}
 	if historyDB != nil {
 		err := database.Close(historyDB)
 		historyDB = nil
@@ -75,106 +138,334 @@ func teardownURLs() error {
 	return nil
 }
 
-func handleURL(conn *irc.Conn, db *sql.DB, line irc.Line, dst string, url *url.URL) {
-	tx, err := db.Begin()
+// addCanonicalColumn upgrades history databases from before URLs were
+// canonicalized, filling in the canonical form of every existing URL.
+func addCanonicalColumn(tx *sql.Tx, driver string) error {
+	if driver == "postgres" {
+		if _, err := tx.Exec("ALTER TABLE seen ADD COLUMN IF NOT EXISTS canonical text"); err != nil {
+			return err
+		}
+	} else if err := addSQLiteCanonicalColumn(tx); err != nil {
+		return err
+	}
+
+	rows, err := tx.Query("SELECT DISTINCT url FROM seen WHERE canonical IS NULL")
 	if err != nil {
-		fmt.Fprintln(os.Stderr, err)
-		return
+		return err
 	}
-	defer func() {
-		sqlstr := "INSERT INTO seen (url, nick, src, dst, timestamp) VALUES (?, ?, ?, ?, ?)"
-		_, err := tx.Exec(sqlstr, url.String(), line.Src.Nick, line.Src.Raw, dst, time.Now())
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "%q: %s\n", err, sqlstr)
-			tx.Rollback()
-		} else {
-			err = tx.Commit()
-			if err != nil {
-				fmt.Fprintln(os.Stderr, err)
-			}
+	var urls []string
+	for rows.Next() {
+		var rawurl string
+		if err := rows.Scan(&rawurl); err != nil {
+			rows.Close()
+			return err
+		}
+		urls = append(urls, rawurl)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, rawurl := range urls {
+		canonical := rawurl
+		if u, err := url.Parse(rawurl); err == nil {
+			canonical = Canonicalize(u)
+		}
+		if _, err := tx.Exec("UPDATE seen SET canonical = ? WHERE url = ?", canonical, rawurl); err != nil {
+			return err
 		}
-	}()
+	}
+	return nil
+}
 
-	sqlstr := "SELECT nick, src, timestamp FROM seen WHERE url = ? AND dst = ? ORDER BY id DESC LIMIT 1"
-	row := tx.QueryRow(sqlstr, url.String(), dst)
+// databases from before migrations may already have the column
+func addSQLiteCanonicalColumn(tx *sql.Tx) error {
+	rows, err := tx.Query("PRAGMA table_info(seen)")
+	if err != nil {
+		return err
+	}
+	found := false
+	for rows.Next() {
+		var cid, notnull, pk int
+		var name, ctype string
+		var dflt sql.NullString
+		if err := rows.Scan(&cid, &name, &ctype, &notnull, &dflt, &pk); err != nil {
+			rows.Close()
+			return err
+		}
+		if name == "canonical" {
+			found = true
+		}
+	}
+	if err := rows.Err(); err != nil || found {
+		return err
+	}
+	_, err = tx.Exec("ALTER TABLE seen ADD COLUMN canonical text")
+	return err
+}
+
+// createSearchIndex creates the full-text index of URLs and page titles,
+// adding any URLs seen before it existed.
+func createSearchIndex(tx *sql.Tx, driver string) error {
+	sqls := []string{
+		"CREATE VIRTUAL TABLE IF NOT EXISTS seen_fts USING fts4 (url, title)",
+		"INSERT INTO seen_fts (docid, url, title) SELECT id, url, '' FROM seen WHERE id NOT IN (SELECT docid FROM seen_fts)",
+	}
+	if driver == "postgres" {
+		// a plain table with an expression index stands in for fts4
+		sqls = []string{
+			"CREATE TABLE IF NOT EXISTS seen_fts (docid bigint not null primary key, url text not null, title text not null)",
+			"CREATE INDEX IF NOT EXISTS seen_fts_idx ON seen_fts USING gin (" + pgSearchVector + ")",
+			sqls[1],
+		}
+	}
+	for _, sqlstr := range sqls {
+		if _, err := tx.Exec(sqlstr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// handleURL records the post and announces reposts. Both happen on w's
+// goroutine, in the order URLs were posted, so that posts waiting to be
+// written are counted and the database isn't read on the dispatch goroutine.
+// Repost notices are therefore sent once the post has been written.
+func handleURL(conn *irc.Conn, w *database.Writer, line irc.Line, dst string, url *url.URL) {
+	canonical := Canonicalize(url)
+	now := time.Now()
+	var id int64
+	var msg string
+	err := w.WriteThen(func(tx *sql.Tx) error {
+		var err error
+		if msg, err = repostNotice(tx, url, canonical, line, dst, now); err != nil {
+			return err
+		}
+		id, err = insertURL(tx, url, canonical, line, dst, now)
+		return err
+	}, func() {
+		if msg != "" {
+			plugin.Conn(conn).Notice(dst, msg)
+		}
+		if config.FetchTitles {
+			go fetchTitle(w, id, url)
+		}
+	})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "urls:", err)
+	}
+}
+
+// repostNotice returns the announcement of a repost of url, or "" if it
+// hasn't been posted in dst before.
+func repostNotice(tx *sql.Tx, url *url.URL, canonical string, line irc.Line, dst string, now time.Time) (string, error) {
+	sqlstr := "SELECT nick, src, timestamp FROM seen WHERE canonical = ? AND dst = ? ORDER BY id DESC LIMIT 1"
+	row := tx.QueryRow(sqlstr, canonical, dst)
 
 	var nick, src string
 	var timestamp time.Time
-	err = row.Scan(&nick, &src, &timestamp)
-	if err != sql.ErrNoRows {
-		if err != nil && err != sql.ErrNoRows {
-			fmt.Fprintf(os.Stderr, "%q: %s\n", err, sqlstr)
-			return
-		}
+	err := row.Scan(&nick, &src, &timestamp)
+	if err == sql.ErrNoRows {
+		return "", nil
+	} else if err != nil {
+		return "", fmt.Errorf("%q: %s", err, sqlstr)
+	}
 
-		if nick == "" {
-			nick = src
+	if nick == "" {
+		// hashed and omitted hostmasks don't say who it was
+		nick = "someone"
+		if i := strings.Index(src, "!"); i > 0 {
+			nick = src[:i]
 		}
+	}
+
+	sqlstr = "SELECT COUNT(*) FROM seen WHERE canonical = ? AND dst = ?"
+	var count int
+	if err := tx.QueryRow(sqlstr, canonical, dst).Scan(&count); err != nil {
+		return "", fmt.Errorf("%q: %s", err, sqlstr)
+	}
 
-		sqlstr = "SELECT COUNT(*) FROM seen WHERE url = ? AND dst = ?"
-		row = tx.QueryRow(sqlstr, url.String(), dst)
+	delta := now.Sub(timestamp)
+	lastSeen := formatDuration(delta)
 
-		var count int
-		err = row.Scan(&count)
+	msg := fmt.Sprintf("URL '%s' was last seen %s ago by %s (%d total)", url, lastSeen, nick, count)
+	if config.RepostShame {
+		// this post hasn't been recorded yet
+		shame, err := reposts(tx, line.Src.Nick, dst)
 		if err != nil {
-			fmt.Fprintln(os.Stderr, err)
-			return
+			return "", err
 		}
+		msg += fmt.Sprintf(" [%s has reposted %s]", line.Src.Nick, pluralize(shame+1, "link"))
+	}
+	return msg, nil
+}
 
-		now := time.Now()
-		delta := now.Sub(timestamp)
-		lastSeen := formatDuration(delta)
+func insertURL(tx *sql.Tx, url *url.URL, canonical string, line irc.Line, dst string, timestamp time.Time) (int64, error) {
+	sqlstr := "INSERT INTO seen (url, canonical, nick, src, dst, timestamp) VALUES (?, ?, ?, ?, ?, ?)"
+	id, err := database.Insert(tx, sqlstr, url.String(), canonical, line.Src.Nick, storedSource(line.Src.Raw), dst, timestamp)
+	if err != nil {
+		return 0, fmt.Errorf("%q: %s", err, sqlstr)
+	}
+	sqlstr = "INSERT INTO seen_fts (docid, url, title) VALUES (?, ?, '')"
+	if _, err := tx.Exec(sqlstr, id, url.String()); err != nil {
+		return 0, fmt.Errorf("%q: %s", err, sqlstr)
+	}
+	return id, nil
+}
 
-		msg := fmt.Sprintf("URL '%s' was last seen %s ago by %s (%d total)", url, lastSeen, nick, count)
-		plugin.Conn(conn).Notice(dst, msg)
+// fetchTitle adds the title of the page to the search index.
+func fetchTitle(w *database.Writer, id int64, url *url.URL) {
+	if url.Scheme != "http" && url.Scheme != "https" {
+		return
 	}
+	page, err := title.Lookup(url)
+	if err != nil || page.Title == "" {
+		return
+	}
+	// the writer may have been closed while the title was fetched
+	w.Write(func(tx *sql.Tx) error {
+		sqlstr := "UPDATE seen_fts SET title = ? WHERE docid = ?"
+		if _, err := tx.Exec(sqlstr, page.String(), id); err != nil {
+			return fmt.Errorf("%q: %s", err, sqlstr)
+		}
+		return nil
+	})
 }
 
 func handleCommand(conn *irc.Conn, db *sql.DB, line irc.Line, arg, dst string, isPrivate bool) {
-	if !isPrivate {
-		conn.Notice(dst, "urls: URL querying must be done over private messages")
-		return
+	words := strings.Fields(arg)
+	subcmd := ""
+	if len(words) > 0 {
+		subcmd, words = strings.ToLower(words[0]), words[1:]
 	}
 
-	arg = strings.TrimSpace(arg)
+	// results are always sent privately
+	reply := line.Src.Nick
+	nickKey := strings.ToLower(line.Src.Nick)
 
-	if arg == "help" {
-		conn.Notice(dst, fmt.Sprintf("urls: usage: %surls", command.CommandPrefix))
-		conn.Notice(dst, "urls: Prints the last 5 URLs seen in all channels")
+	var q *query
+	switch subcmd {
+	case "help":
+		plugin.Conn(conn).Notice(reply, fmt.Sprintf("urls: usage: %surls [search <terms>] | %surls more | %surls stats | %surls forget [url]", command.CommandPrefix, command.CommandPrefix, command.CommandPrefix, command.CommandPrefix))
+		plugin.Conn(conn).Notice(reply, "urls: Prints the last 5 URLs seen, or those matching the search terms. Search terms match the URL and page title,")
+		plugin.Conn(conn).Notice(reply, "urls: and may include nick:<nick> chan:<#channel> host:<host> since:<YYYY-MM-DD> until:<YYYY-MM-DD>")
+		plugin.Conn(conn).Notice(reply, "urls: In a channel, only that channel's URLs are shown. In private, only URLs from channels you are in are shown.")
+		plugin.Conn(conn).Notice(reply, "urls: stats shows the top posters, reposts and domains, and recent activity per channel")
+		plugin.Conn(conn).Notice(reply, "urls: forget deletes every URL posted from your hostmask, or just the given one")
+		return
+	case "stats":
+		q = &query{}
+		if !restrict(conn, line, dst, isPrivate, reply, q) {
+			return
+		}
+		lines, err := stats(db, q)
+		if err != nil {
+			fmt.Println("error in !urls stats:", err)
+			plugin.Conn(conn).Notice(reply, "urls: Internal error occurred")
+			return
+		}
+		if len(lines) == 0 {
+			plugin.Conn(conn).Notice(reply, "urls: no URLs found")
+		}
+		for _, text := range lines {
+			plugin.Conn(conn).Notice(reply, "urls: "+text)
+		}
+		return
+	case "forget":
+		canonical := ""
+		if len(words) > 0 {
+			u, err := url.Parse(words[0])
+			if err != nil || u.Host == "" {
+				plugin.Conn(conn).Notice(reply, fmt.Sprintf("urls: invalid URL %q", words[0]))
+				return
+			}
+			canonical = Canonicalize(u)
+		}
+		count, err := forget(db, line.Src.Raw, canonical)
+		if err == errNoSources {
+			plugin.Conn(conn).Notice(reply, "urls: forget is unavailable, as the hostmasks of posters aren't recorded")
+			return
+		} else if err != nil {
+			fmt.Println("error in !urls forget:", err)
+			plugin.Conn(conn).Notice(reply, "urls: Internal error occurred")
+			return
+		}
+		if count == 0 {
+			plugin.Conn(conn).Notice(reply, "urls: no URLs to forget")
+		} else {
+			plugin.Conn(conn).Notice(reply, fmt.Sprintf("urls: forgot %s", pluralize(count, "URL")))
+		}
+		return
+	case "more":
+		queries.Lock()
+		q = queries.byNick[nickKey]
+		queries.Unlock()
+		if q == nil {
+			plugin.Conn(conn).Notice(reply, "urls: no more URLs")
+			return
+		}
+	case "", "search":
+		var err error
+		if q, err = parseQuery(words); err != nil {
+			plugin.Conn(conn).Notice(reply, "urls: "+err.Error())
+			return
+		}
+		if !restrict(conn, line, dst, isPrivate, reply, q) {
+			return
+		}
+	default:
+		plugin.Conn(conn).Notice(reply, fmt.Sprintf("urls: unknown command %q, try %surls help", subcmd, command.CommandPrefix))
 		return
 	}
 
-	sqlstr := "SELECT nick, src, timestamp, dst, url FROM seen GROUP BY url ORDER BY id DESC LIMIT ?"
-	n := 5
-	rows, err := db.Query(sqlstr, n)
-
+	results, more, err := q.next(db)
 	if err != nil {
 		fmt.Println("error in !urls:", err)
-		conn.Notice(dst, "urls: Internal error occurred")
+		plugin.Conn(conn).Notice(reply, "urls: Internal error occurred")
 		return
 	}
 
-	for rows.Next() {
-		reply := dst
-		var nick, src, dst, url string
-		var timestamp time.Time
-		if err = rows.Scan(&nick, &src, &timestamp, &dst, &url); err != nil {
-			fmt.Println("error in !urls:", err)
-			conn.Notice(dst, "urls: Internal error occurred")
-			rows.Close()
-			return
-		}
-		if nick == "" {
-			nick = src
+	queries.Lock()
+	if more {
+		queries.byNick[nickKey] = q
+	} else {
+		delete(queries.byNick, nickKey)
+	}
+	queries.Unlock()
+
+	if len(results) == 0 {
+		plugin.Conn(conn).Notice(reply, "urls: no URLs found")
+		return
+	}
+	for _, r := range results {
+		timestr := r.timestamp.Format("01-02 15:04:05")
+		msg := fmt.Sprintf("%s: %s: %s by %s", timestr, r.dst, r.url, r.nick)
+		if r.title != "" {
+			msg += " | " + r.title
 		}
-		timestr := timestamp.Format("01-02 15:04:05")
-		conn.Notice(reply, fmt.Sprintf("%s: %s: %s by %s", timestr, dst, url, nick))
-		n -= 1
+		plugin.Conn(conn).Notice(reply, msg)
 	}
+	if more {
+		plugin.Conn(conn).Notice(reply, fmt.Sprintf("(%surls more for more URLs)", command.CommandPrefix))
+	} else {
+		plugin.Conn(conn).Notice(reply, "(no more URLs)")
+	}
+}
 
-	if n > 0 {
-		conn.Notice(dst, "(no more URLs)")
+// restrict limits q to the channel the command was given in, or to the
+// channels the user is in if it was given privately. It returns false if
+// there are no such channels.
+func restrict(conn *irc.Conn, line irc.Line, dst string, isPrivate bool, reply string, q *query) bool {
+	if !isPrivate {
+		q.scope([]string{dst})
+		return true
+	}
+	channels := channelsOf(line.Src.Nick)
+	if len(channels) == 0 {
+		plugin.Conn(conn).Notice(reply, "urls: you aren't in any channels that I'm in")
+		return false
 	}
+	q.scope(channels)
+	return true
 }
 
 func formatDuration(d time.Duration) string {
@@ -0,0 +1,35 @@
+package youtube
+
+import (
+	"regexp"
+	"testing"
+)
+
+func TestKey(t *testing.T) {
+	key := regexp.MustCompile(provider.Key)
+	tests := []struct {
+		url, key string
+	}{
+		{"https://www.youtube.com/watch?v=dQw4w9WgXcQ", "dQw4w9WgXcQ"},
+		{"http://youtube.com/watch?feature=share&v=dQw4w9WgXcQ&t=30", "dQw4w9WgXcQ"},
+		{"https://m.youtube.com/watch?v=dQw4w9WgXcQ#t=1m", "dQw4w9WgXcQ"},
+		{"https://WWW.YouTube.com:443/watch?v=dQw4w9WgXcQ", "dQw4w9WgXcQ"},
+		{"https://youtu.be/dQw4w9WgXcQ", "dQw4w9WgXcQ"},
+		{"https://youtu.be/dQw4w9WgXcQ?t=30", "dQw4w9WgXcQ"},
+		{"https://www.youtube.com/watch?v=short", ""},
+		{"https://www.youtube.com/watch?v=dQw4w9WgXcQQ", ""},
+		{"https://www.youtube.com/watch", ""},
+		{"https://www.youtube.com/channel/dQw4w9WgXcQ", ""},
+		{"https://www.youtube.com/watch?x=1#v=dQw4w9WgXcQ", ""},
+		{"https://youtu.be/", ""},
+	}
+	for _, test := range tests {
+		got := ""
+		if m := key.FindStringSubmatch(test.url); m != nil {
+			got = m[1]
+		}
+		if got != test.key {
+			t.Errorf("key of %q = %q, want %q", test.url, got, test.key)
+		}
+	}
+}
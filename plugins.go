@@ -5,11 +5,16 @@ import (
 	_ "./plugin/appdotnet"
 	_ "./plugin/command"
 	_ "./plugin/dogecoin"
+	_ "./plugin/factoids"
 	_ "./plugin/flickr"
+	_ "./plugin/preview"
 	_ "./plugin/reaction"
 	_ "./plugin/sed"
 	_ "./plugin/stocks"
+	_ "./plugin/title"
 	_ "./plugin/tweet"
+	_ "./plugin/unshorten"
+	_ "./plugin/urlevent"
 	_ "./plugin/urls"
 	_ "./plugin/vimeo"
 	_ "./plugin/vine"
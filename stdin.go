@@ -1,6 +1,7 @@
 package main
 
 import (
+	"./plugin/database"
 	"bufio"
 	"fmt"
 	"github.com/kballard/goirc/irc"
@@ -103,4 +104,14 @@ var inputCommands = map[string]func(irc.SafeConn, string){
 		fmt.Printf("--> NICK: %s\n", words[0])
 		conn.Nick(words[0])
 	},
+	"writers": func(conn irc.SafeConn, text string) {
+		stats := database.Stats()
+		if len(stats) == 0 {
+			fmt.Println("No database writers are running")
+		}
+		for _, s := range stats {
+			fmt.Printf("%s: %d/%d pending, %d written, %d failed, %d batches (last took %s), blocked %d times for %s\n",
+				s.Name, s.Pending, s.Capacity, s.Written, s.Failed, s.Batches, s.LastFlush, s.Blocked, s.BlockedTime)
+		}
+	},
 }
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"./plugin/database"
+	"flag"
+	"fmt"
+	"github.com/kballard/goirc/irc"
+	"os"
+	"strings"
+)
+
+// Subcommands are available both from the command line, e.g. voidbot
+// export-urls foo.csv, and from standard input while the bot is running,
+// e.g. /export-urls foo.csv. They are told whether the bot is running, as
+// standard input can't be used for data then.
+var subcommands = map[string]func(args []string, running bool) error{
+	"backup":      backupDatabases,
+	"export-urls": exportURLs,
+	"import-urls": importURLs,
+	"migrate":     migrateDatabases,
+}
+
+func init() {
+	for name, f := range subcommands {
+		f := f
+		inputCommands[name] = func(conn irc.SafeConn, text string) {
+			if err := f(strings.Fields(text), true); err != nil && err != flag.ErrHelp {
+				fmt.Fprintln(os.Stderr, "error:", err)
+			}
+		}
+	}
+}
+
+// runSubcommand runs the subcommand named by args[0], exiting on failure.
+func runSubcommand(args []string) {
+	f, ok := subcommands[args[0]]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "error: unknown command %q\n", args[0])
+		os.Exit(2)
+	}
+	if err := os.MkdirAll(*dataDir, 0755); err != nil {
+		fmt.Fprintln(os.Stderr, "error: could not create data directory:", err)
+		os.Exit(1)
+	}
+	database.SetDataDir(*dataDir)
+	if err := f(args[1:], false); err == flag.ErrHelp {
+		os.Exit(2)
+	} else if err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		os.Exit(1)
+	}
+}
+
+func migrateDatabases(args []string, running bool) error {
+	flags := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	dryRun := flags.Bool("dry-run", false, "only list the pending migrations")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: migrate [-dry-run]")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return err
+	} else if flags.NArg() > 0 {
+		flags.Usage()
+		return flag.ErrHelp
+	}
+
+	var pending []database.Pending
+	var err error
+	if *dryRun {
+		pending, err = database.PendingMigrations()
+	} else {
+		pending, err = database.Migrate()
+	}
+	if err != nil {
+		return err
+	}
+	verb := "applied"
+	if *dryRun {
+		verb = "pending"
+	}
+	for _, p := range pending {
+		fmt.Printf("%s: %s %d: %s (%s)\n", p.Path, p.Name, p.Version, p.Description, verb)
+	}
+	if len(pending) == 0 {
+		fmt.Println("All databases are up to date")
+	}
+	return nil
+}
+
+func backupDatabases(args []string, running bool) error {
+	flags := flag.NewFlagSet("backup", flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: backup")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return err
+	} else if flags.NArg() > 0 {
+		flags.Usage()
+		return flag.ErrHelp
+	}
+
+	backups, err := database.Backup()
+	for _, path := range backups {
+		fmt.Println("backed up to", path)
+	}
+	return err
+}
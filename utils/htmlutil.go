@@ -88,3 +88,38 @@ func PrefixMap(node *html.Node) map[string]string {
 	}
 	return nil
 }
+
+// OpenGraph returns the OpenGraph properties found in the document's meta
+// tags, keyed without the prefix (e.g. "title" for og:title). If the document
+// doesn't declare a prefix for OpenGraph, "og" is assumed.
+func OpenGraph(doc *html.Node) map[string]string {
+	prefixes := PrefixMap(doc)
+	if prefixes == nil {
+		// Many sites don't declare the prefix, and some (like Vine) have
+		// markup that causes the HTML5 parser to drop it.
+		prefixes = map[string]string{"og": "http://ogp.me/ns#"}
+	}
+	props := make(map[string]string)
+	var f func(*html.Node)
+	f = func(n *html.Node) {
+		if n.Type == html.ElementNode {
+			if n.DataAtom == atom.Body {
+				// meta tags belong in the head
+				return
+			}
+			if n.DataAtom == atom.Meta {
+				comps := strings.SplitN(NodeAttr(n, "property"), ":", 2)
+				if len(comps) == 2 && prefixes[comps[0]] == "http://ogp.me/ns#" {
+					if _, ok := props[comps[1]]; !ok {
+						props[comps[1]] = NodeAttr(n, "content")
+					}
+				}
+			}
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			f(c)
+		}
+	}
+	f(doc)
+	return props
+}
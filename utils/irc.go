@@ -1,7 +1,54 @@
 package utils
 
 import (
+	"fmt"
 	"regexp"
+	"strings"
 )
 
 var NickRegex = regexp.MustCompile("[a-zA-Z\\x5B-\\x60\\x7B-\\x7D[\\]\\\\`_^{|}][a-zA-Z0-9\\x5B-\\x60\\x7B-\\x7D[\\]\\\\`_^{|}\\-]*")
+
+func IsChannelName(name string) bool {
+	return len(name) > 0 && (name[0] == '#' || name[0] == '&' || name[0] == '!' || name[0] == '+')
+}
+
+// GlobRegexp matches the whole of a string against a glob, where * matches
+// any text and ? any character, ignoring case.
+func GlobRegexp(glob string) (*regexp.Regexp, error) {
+	pat := regexp.QuoteMeta(glob)
+	pat = strings.Replace(pat, `\*`, ".*", -1)
+	pat = strings.Replace(pat, `\?`, ".", -1)
+	return regexp.Compile("(?i)^" + pat + "$")
+}
+
+// Hostmasks are globs of the form nick!user@host, e.g. *!*@example.com, as
+// used in the trusted lists of plugin configs.
+type Hostmasks []*regexp.Regexp
+
+// CompileHostmasks checks that each mask is of the form nick!user@host and
+// compiles it.
+func CompileHostmasks(masks []string) (Hostmasks, error) {
+	var hostmasks Hostmasks
+	for _, mask := range masks {
+		if !strings.Contains(mask, "!") || !strings.Contains(mask, "@") {
+			return nil, fmt.Errorf("hostmask %q must be of the form nick!user@host", mask)
+		}
+		re, err := GlobRegexp(mask)
+		if err != nil {
+			return nil, err
+		}
+		hostmasks = append(hostmasks, re)
+	}
+	return hostmasks, nil
+}
+
+// Match returns whether src, of the form nick!user@host, matches any of the
+// hostmasks.
+func (h Hostmasks) Match(src string) bool {
+	for _, re := range h {
+		if re.MatchString(src) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,59 @@
+package utils
+
+import "testing"
+
+func TestGlobRegexp(t *testing.T) {
+	tests := []struct {
+		glob, s string
+		ok      bool
+	}{
+		{"*good morning*", "Good Morning everyone", true},
+		{"good?morning", "good-morning", true},
+		{"good?morning", "goodmorning", false},
+		{"a.b", "a.b", true},
+		{"a.b", "axb", false},
+		{"(x)", "(X)", true},
+		{"foo", "foobar", false},
+	}
+	for _, test := range tests {
+		re, err := GlobRegexp(test.glob)
+		if err != nil {
+			t.Errorf("GlobRegexp(%q): %v", test.glob, err)
+		} else if got := re.MatchString(test.s); got != test.ok {
+			t.Errorf("GlobRegexp(%q) matches %q = %v, want %v", test.glob, test.s, got, test.ok)
+		}
+	}
+}
+
+func TestHostmasks(t *testing.T) {
+	h, err := CompileHostmasks([]string{"*!*@example.com", "alice!~a@*"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		src string
+		ok  bool
+	}{
+		{"bob!b@example.com", true},
+		{"Bob!b@EXAMPLE.COM", true},
+		{"bob!b@evil.example.com", false},
+		{"bob!b@example.com.evil.com", false},
+		{"alice!~a@anywhere", true},
+		{"alice!a@anywhere", false},
+		{"", false},
+	}
+	for _, test := range tests {
+		if got := h.Match(test.src); got != test.ok {
+			t.Errorf("Match(%q) = %v, want %v", test.src, got, test.ok)
+		}
+	}
+
+	for _, mask := range []string{"example.com", "*@example.com", "nick!user"} {
+		if _, err := CompileHostmasks([]string{mask}); err == nil {
+			t.Errorf("CompileHostmasks accepted %q", mask)
+		}
+	}
+	if h, err := CompileHostmasks(nil); err != nil || h.Match("bob!b@example.com") {
+		t.Errorf("an empty list matched, or failed: %v", err)
+	}
+}
@@ -80,3 +80,18 @@ func MatchCase(s, src string) string {
 
 	return string(runes)
 }
+
+// Truncate cuts s to at most n bytes without splitting a UTF-8 sequence,
+// and appends an ellipsis if anything was cut.
+func Truncate(s string, n int) string {
+	if n < 0 {
+		n = 0
+	}
+	if n >= len(s) {
+		return s
+	}
+	for n > 0 && s[n]&0xC0 == 0x80 {
+		n--
+	}
+	return s[:n] + "..."
+}
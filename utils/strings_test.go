@@ -0,0 +1,26 @@
+package utils
+
+import "testing"
+
+func TestTruncate(t *testing.T) {
+	tests := []struct {
+		s    string
+		n    int
+		want string
+	}{
+		{"hello world", 5, "hello..."},
+		{"hello", 5, "hello"},
+		{"hello", 10, "hello"},
+		{"hello", 0, "..."},
+		{"hello", -3, "..."},
+		{"", -1, ""},
+		{"héllo", 2, "h..."},
+		{"héllo", 3, "hé..."},
+		{"日本語", 4, "日..."},
+	}
+	for _, test := range tests {
+		if got := Truncate(test.s, test.n); got != test.want {
+			t.Errorf("Truncate(%q, %d) = %q, want %q", test.s, test.n, got, test.want)
+		}
+	}
+}